@@ -0,0 +1,101 @@
+package channel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Content types the Hub's clients know how to handle
+const (
+	JSONContentType   = "application/json"
+	FormContentType   = "application/x-www-form-urlencoded"
+	BinaryContentType = "application/octet-stream"
+)
+
+// Base64Encoding marks a payload that was base64 encoded because it is binary
+const Base64Encoding = "base64"
+
+// ContentKind groups content types by how their payloads are validated and rendered
+type ContentKind int
+
+const (
+	// BinaryContent is any payload not known to be text
+	BinaryContent ContentKind = iota
+	// TextContent is UTF-8 text
+	TextContent
+	// JSONContent is a JSON document
+	JSONContent
+	// FormContent is a form-encoded set of values
+	FormContent
+)
+
+// KindOf classifies a content type, JSON includes structured suffixes such as application/ld+json
+func KindOf(contentType string) ContentKind {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return BinaryContent
+	}
+
+	switch {
+	case mediaType == JSONContentType || strings.HasSuffix(mediaType, "+json"):
+		return JSONContent
+	case mediaType == FormContentType:
+		return FormContent
+	case strings.HasPrefix(mediaType, "text/"):
+		return TextContent
+	}
+
+	return BinaryContent
+}
+
+// DetectContentType picks a content type for a payload published without one
+func DetectContentType(payload []byte) string {
+	if utf8.Valid(payload) {
+		return TextContentType
+	}
+
+	return BinaryContentType
+}
+
+// ValidatePayload checks the payload is well formed for its content type. Binary payloads are
+// never rejected, and text is only required to be UTF-8 when no other charset is declared.
+func ValidatePayload(contentType string, payload []byte) error {
+	switch KindOf(contentType) {
+	case JSONContent:
+		var v interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return fmt.Errorf("malformed JSON payload: %v", err)
+		}
+	case FormContent:
+		if _, err := url.ParseQuery(string(payload)); err != nil {
+			return fmt.Errorf("malformed form payload: %v", err)
+		}
+	case TextContent:
+		_, params, _ := mime.ParseMediaType(contentType)
+		charset := strings.ToLower(params["charset"])
+
+		if (charset == "" || charset == "utf-8") && !utf8.Valid(payload) {
+			return fmt.Errorf("text payload is not valid UTF-8")
+		}
+	}
+
+	return nil
+}
+
+// EncodedPayload returns the payload as a string for JSON clients. Binary payloads, and text
+// that is not UTF-8 such as text in another charset, are base64 encoded and reported with
+// Base64Encoding, other payloads are returned as they are with no encoding.
+func (m Message) EncodedPayload() (payload string, encoding string) {
+	binary := KindOf(m.ContentType) == BinaryContent && m.ContentType != ""
+
+	if binary || !utf8.Valid(m.Payload) {
+		return base64.StdEncoding.EncodeToString(m.Payload), Base64Encoding
+	}
+
+	return string(m.Payload), ""
+}
@@ -0,0 +1,68 @@
+package channel
+
+import "testing"
+
+func TestKindOf(t *testing.T) {
+	cases := []struct {
+		contentType string
+		want        ContentKind
+	}{
+		{"application/json", JSONContent},
+		{"application/json; charset=utf-8", JSONContent},
+		{"application/ld+json", JSONContent},
+		{"application/x-www-form-urlencoded", FormContent},
+		{TextContentType, TextContent},
+		{"text/csv", TextContent},
+		{"image/png", BinaryContent},
+		{"", BinaryContent},
+	}
+
+	for _, c := range cases {
+		if kind := KindOf(c.contentType); kind != c.want {
+			t.Errorf("KindOf(%q) = %v, want %v", c.contentType, kind, c.want)
+		}
+	}
+}
+
+func TestValidatePayload(t *testing.T) {
+	cases := []struct {
+		contentType string
+		payload     string
+		valid       bool
+	}{
+		{"application/json", `{"temp": 21.5}`, true},
+		{"application/json", `{"temp": }`, false},
+		{"application/x-www-form-urlencoded", "temp=21.5&unit=C", true},
+		{"application/x-www-form-urlencoded", "temp=%zz", false},
+		{TextContentType, "21.5", true},
+		{"text/plain", "\xff\xfe", false},
+		{"text/plain; charset=latin1", "\xff\xfe", true},
+		{"image/png", "\x89PNG\xff", true},
+	}
+
+	for _, c := range cases {
+		if err := ValidatePayload(c.contentType, []byte(c.payload)); (err == nil) != c.valid {
+			t.Errorf("ValidatePayload(%q, %q) = %v, want valid %v", c.contentType, c.payload, err, c.valid)
+		}
+	}
+}
+
+func TestEncodedPayload(t *testing.T) {
+	cases := []struct {
+		message  Message
+		payload  string
+		encoding string
+	}{
+		{Message{Payload: []byte("21.5"), ContentType: TextContentType}, "21.5", ""},
+		{Message{Payload: []byte(`{"temp": 21.5}`), ContentType: JSONContentType}, `{"temp": 21.5}`, ""},
+		{Message{Payload: []byte("21.5")}, "21.5", ""},
+		{Message{Payload: []byte{0xff, 0x00}, ContentType: BinaryContentType}, "/wA=", Base64Encoding},
+		{Message{Payload: []byte("caf\xe9"), ContentType: "text/plain; charset=iso-8859-1"}, "Y2Fm6Q==", Base64Encoding},
+	}
+
+	for _, c := range cases {
+		if payload, encoding := c.message.EncodedPayload(); payload != c.payload || encoding != c.encoding {
+			t.Errorf("EncodedPayload(%q, %q) = %q, %q, want %q, %q", c.message.ContentType, c.message.Payload, payload, encoding, c.payload, c.encoding)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package channel
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDuplicate is returned by Publish, along with the message as first published, when a
+// publisher reuses the ID of a message it published to the same topic within the Hub's DedupWindow
+var ErrDuplicate = errors.New("duplicate message")
+
+// dedupKey scopes a message ID to its publisher and topic
+type dedupKey struct {
+	publisher string
+	topic     string
+	id        string
+}
+
+// published is a message remembered for deduplication
+type published struct {
+	message Message
+	at      time.Time
+}
+
+func newDedupKey(message Message) dedupKey {
+	return dedupKey{publisher: message.Publisher, topic: message.Topic, id: message.ID}
+}
+
+// Duplicate returns the message first published with the message's ID by the same Publisher to
+// the same topic, if it was published within the DedupWindow
+func (ch *Hub) Duplicate(message Message) (Message, bool) {
+	if ch.DedupWindow <= 0 || message.ID == "" {
+		return Message{}, false
+	}
+
+	ch.Lock()
+	defer ch.Unlock()
+
+	ch.init()
+
+	return ch.duplicate(newDedupKey(message), time.Now())
+}
+
+// duplicate returns the message first published with the key, the lock must be held
+func (ch *Hub) duplicate(key dedupKey, now time.Time) (Message, bool) {
+	ch.expireDedup(now)
+
+	p, ok := ch.dedup[key]
+
+	return p.message, ok
+}
+
+// remember keeps the message for DedupWindow so it can be returned for a repeated ID.
+// The lock must be held.
+func (ch *Hub) remember(message Message, now time.Time) {
+	key := newDedupKey(message)
+
+	ch.dedup[key] = published{message: message, at: now}
+	ch.dedupOrder = append(ch.dedupOrder, key)
+}
+
+// expireDedup forgets messages published longer than DedupWindow ago, the lock must be held
+func (ch *Hub) expireDedup(now time.Time) {
+	expired := 0
+	for _, key := range ch.dedupOrder {
+		if now.Sub(ch.dedup[key].at) <= ch.DedupWindow {
+			break
+		}
+
+		delete(ch.dedup, key)
+		expired++
+	}
+
+	ch.dedupOrder = ch.dedupOrder[expired:]
+}
@@ -0,0 +1,102 @@
+package channel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublishDeduplicatesIDs(t *testing.T) {
+	hub := Hub{DedupWindow: time.Minute}
+
+	s, _ := hub.Subscribe(context.Background(), "#")
+	defer s.Unsubscribe()
+
+	first, err := hub.Publish(Message{ID: "reading-1", Topic: "sensors/temp", Payload: []byte("21.5")})
+	if err != nil {
+		t.Fatalf("Publish(reading-1) = %v, want nil", err)
+	}
+
+	again, err := hub.Publish(Message{ID: "reading-1", Topic: "sensors/temp", Payload: []byte("21.5")})
+	if err != ErrDuplicate || again.Sequence != first.Sequence || again.Timestamp != first.Timestamp {
+		t.Errorf("Publish(reading-1) again = %v, %v, want sequence %v, ErrDuplicate", again.Sequence, err, first.Sequence)
+	}
+
+	if _, err := hub.Publish(Message{Topic: "sensors/temp", Payload: []byte("21.5")}); err != nil {
+		t.Errorf("Publish() without ID = %v, want nil", err)
+	}
+
+	for _, want := range []uint64{1, 2} {
+		if received := <-s.C; received.Sequence != want {
+			t.Errorf("Received sequence %v, want %v", received.Sequence, want)
+		}
+	}
+
+	select {
+	case received := <-s.C:
+		t.Errorf("Received %v, want the duplicate dropped", received.Sequence)
+	default:
+	}
+}
+
+func TestDuplicateIDsAreScopedToPublisherAndTopic(t *testing.T) {
+	hub := Hub{DedupWindow: time.Minute}
+
+	hub.Publish(Message{ID: "reading-1", Topic: "sensors/temp", Publisher: "a"})
+
+	for _, m := range []Message{
+		{ID: "reading-1", Topic: "sensors/temp", Publisher: "b"},
+		{ID: "reading-1", Topic: "sensors/humidity", Publisher: "a"},
+	} {
+		if _, ok := hub.Duplicate(m); ok {
+			t.Errorf("Duplicate(%v %v) = true, want false", m.Publisher, m.Topic)
+		}
+
+		if _, err := hub.Publish(m); err != nil {
+			t.Errorf("Publish(%v %v) = %v, want nil", m.Publisher, m.Topic, err)
+		}
+	}
+
+	if original, ok := hub.Duplicate(Message{ID: "reading-1", Topic: "sensors/temp", Publisher: "a"}); !ok || original.Sequence != 1 {
+		t.Errorf("Duplicate(a sensors/temp) = %v, %v, want sequence 1", original.Sequence, ok)
+	}
+}
+
+func TestDedupWindowExpires(t *testing.T) {
+	hub := Hub{DedupWindow: 10 * time.Millisecond}
+
+	hub.Publish(Message{ID: "reading-1", Topic: "sensors/temp"})
+	time.Sleep(20 * time.Millisecond)
+
+	if message, err := hub.Publish(Message{ID: "reading-1", Topic: "sensors/temp"}); err != nil || message.Sequence != 2 {
+		t.Errorf("Publish(reading-1) after window = %v, %v, want sequence 2", message.Sequence, err)
+	}
+
+	if len(hub.dedup) != 1 || len(hub.dedupOrder) != 1 {
+		t.Errorf("dedup holds %v messages, want 1", len(hub.dedup))
+	}
+}
+
+func TestPublishWithoutWindowKeepsDuplicates(t *testing.T) {
+	var hub Hub
+
+	hub.Publish(Message{ID: "reading-1", Topic: "sensors/temp"})
+
+	if message, err := hub.Publish(Message{ID: "reading-1", Topic: "sensors/temp"}); err != nil || message.Sequence != 2 {
+		t.Errorf("Publish(reading-1) again = %v, %v, want sequence 2", message.Sequence, err)
+	}
+}
+
+func TestAddressPublisherIgnoresPort(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.1:5000": "address 10.0.0.1",
+		"[::1]:5000":    "address ::1",
+		"10.0.0.1":      "address 10.0.0.1",
+	}
+
+	for remoteAddr, want := range cases {
+		if got := AddressPublisher(remoteAddr); got != want {
+			t.Errorf("AddressPublisher(%q) = %q, want %q", remoteAddr, got, want)
+		}
+	}
+}
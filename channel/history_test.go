@@ -0,0 +1,131 @@
+package channel
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRingKeepsMostRecentMessages(t *testing.T) {
+	r := newRing(3)
+
+	for _, m := range []string{"one", "two", "three", "four"} {
+		r.push(NewTextMessage("c1", m))
+	}
+
+	received := make([]string, 0)
+	r.each(func(m Message) { received = append(received, m.String()) })
+
+	if len(received) != 3 || received[0] != "two" || received[2] != "four" {
+		t.Errorf("ring.each() = %v, want [two three four]", received)
+	}
+}
+
+func TestPublishAssignsIncreasingSequence(t *testing.T) {
+	var ch Hub
+
+	first, _ := ch.Publish(NewTextMessage("c1", "one"))
+	second, _ := ch.Publish(NewTextMessage("c2", "two"))
+
+	if first.Sequence == 0 || second.Sequence != first.Sequence+1 {
+		t.Errorf("Publish(); Sequence = %v, %v, want increasing from 1", first.Sequence, second.Sequence)
+	}
+}
+
+func TestSubscribeFromOffset(t *testing.T) {
+	ch := Hub{HistorySize: 2}
+
+	start := time.Now()
+	for _, m := range []string{"one", "two", "three"} {
+		ch.SendMessage(m, "sensors/temp")
+		ch.SendMessage(m, "actuators/fan")
+	}
+
+	cases := []struct {
+		name   string
+		offset Offset
+		want   []string
+	}{
+		{"Latest()", Latest(), []string{}},
+		{"Earliest()", Earliest(), []string{"two", "three"}},
+		{"FromSequence(5)", FromSequence(5), []string{"three"}},
+		{"FromTime(start)", FromTime(start), []string{"two", "three"}},
+		{"FromTime(future)", FromTime(time.Now().Add(time.Hour)), []string{}},
+	}
+
+	for _, c := range cases {
+		s, _ := ch.SubscribeWith(context.Background(), []string{"sensors/#"}, From(c.offset))
+
+		for _, expected := range c.want {
+			select {
+			case received := <-s.C:
+				if received.String() != expected || received.Topic != "sensors/temp" {
+					t.Errorf("From(%v); Received = %v: %v, want sensors/temp: %v", c.name, received.Topic, received, expected)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("From(%v); received nothing, want %v", c.name, expected)
+			}
+		}
+
+		select {
+		case received := <-s.C:
+			t.Errorf("From(%v); Received = %v, want no more messages", c.name, received)
+		default:
+		}
+
+		s.Unsubscribe()
+	}
+}
+
+func TestAfterSequenceAheadOfHubStartsFromEarliest(t *testing.T) {
+	var ch Hub
+
+	ch.SendMessage("one", "c1")
+	ch.SendMessage("two", "c1")
+
+	cases := []struct {
+		after uint64
+		want  Offset
+	}{
+		{0, FromSequence(1)},
+		{1, FromSequence(2)},
+		{2, FromSequence(3)},
+		{3, Earliest()},
+		{^uint64(0), Earliest()},
+	}
+
+	for _, c := range cases {
+		if got := ch.After(c.after); got != c.want {
+			t.Errorf("After(%v) = %+v, want %+v", c.after, got, c.want)
+		}
+	}
+}
+
+func TestHistoryForgetsTopicPublishedToLongestAgo(t *testing.T) {
+	ch := Hub{HistorySize: 2, HistoryTopics: 2}
+
+	ch.SendMessage("one", "c1")
+	ch.SendMessage("two", "c2")
+	ch.SendMessage("three", "c1")
+	ch.SendMessage("four", "c3")
+
+	received := make([]string, 0)
+	for _, m := range ch.History([]string{"#"}, Earliest()) {
+		received = append(received, m.Topic+": "+m.String())
+	}
+
+	if want := "c1: one, c1: three, c3: four"; strings.Join(received, ", ") != want {
+		t.Errorf("History() = %v, want %v", strings.Join(received, ", "), want)
+	}
+}
+
+func TestHistoryIsDisabledByDefault(t *testing.T) {
+	var ch Hub
+
+	ch.SendMessage("one", "c1")
+
+	if history := ch.History([]string{"#"}, Earliest()); len(history) != 0 {
+		t.Errorf("History() = %v, want none", history)
+	}
+}
@@ -1,74 +1,496 @@
 package channel
 
 import (
+	"container/list"
+	"context"
 	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// drainInterval is how often Drain checks whether the subscribers have caught up
+const drainInterval = 10 * time.Millisecond
+
+// defaultHistoryTopics is the most topics history is kept for when HistoryTopics is not set
+const defaultHistoryTopics = 1000
+
 // Hub is responsible for piping messages to all registered channels
 type Hub struct {
 	sync.RWMutex
-	channels map[*chan string]map[string]struct{}
+	subscribers map[*subscriber]struct{}
+	channels    map[interface{}]*subscriber
+	topics      *topicNode
+	retained    map[string]Message
+	history     map[string]*ring
+	historyAge  *list.List
+	sequence    uint64
+	dedup       map[dedupKey]published
+	dedupOrder  []dedupKey
+	publishing  int32
+
+	// order is held from sequencing a message until it is queued for every subscriber, so
+	// subscribers receive messages in sequence order
+	order sync.Mutex
+
+	// HistorySize is the number of recent messages kept per topic for subscriptions that start
+	// from an earlier Offset. Zero disables history.
+	HistorySize int
+
+	// HistoryTopics is the most topics history is kept for. Once it is reached, the history of
+	// the topic published to longest ago is forgotten. Zero keeps up to 1000 topics.
+	HistoryTopics int
+
+	// Store, when set, durably records every message before it is delivered, see Restore
+	Store Store
+
+	// DedupWindow is how long a message published with its own ID is remembered. The same
+	// Publisher publishing the same ID to the same topic again within the window gets the original
+	// message with ErrDuplicate instead of delivering it twice. Zero disables deduplication.
+	DedupWindow time.Duration
 }
 
-// SendMessage publishes a message to all matching channels registered to the topic
-func (ch *Hub) SendMessage(message string, topic string) {
-	ch.RLock()
-	defer ch.RUnlock()
+// Publish sends a message to all matching channels registered to the message topic and returns
+// the message as published, with its Sequence, ID and Timestamp assigned.
+// Messages are queued for each subscriber and a full queue is handled by the subscriber's Policy,
+// so a slow subscriber only blocks publishers when it registered with Block. Messages are queued
+// in sequence order, so a blocked publish also holds up the publishes after it.
+// It fails when the message could not be recorded by the Store, in which case it is not
+// delivered, or was a duplicate, see DedupWindow.
+func (ch *Hub) Publish(message Message) (Message, error) {
+	// Only IDs chosen by the publisher can repeat
+	deduplicate := ch.DedupWindow > 0 && message.ID != ""
+	now := time.Now()
 
-	for channel := range ch.channels {
-		_, allTopics := ch.channels[channel]["*"]
-		_, topicMatch := ch.channels[channel][topic]
+	// Drain waits for publishes that are still queueing their message
+	atomic.AddInt32(&ch.publishing, 1)
+	defer atomic.AddInt32(&ch.publishing, -1)
 
-		// If we do not have a topic match, skip the channel
-		if !(allTopics || topicMatch) {
-			continue
+	message = message.stamp()
+
+	ch.order.Lock()
+	defer ch.order.Unlock()
+
+	matched := make(map[*subscriber]struct{})
+
+	// Sequencing, history and matching share the write lock so a subscriber registering at the
+	// same time receives each message either from history or retained values, or live, never both
+	ch.Lock()
+	ch.init()
+
+	if deduplicate {
+		if original, ok := ch.duplicate(newDedupKey(message), now); ok {
+			ch.Unlock()
+			return original, ErrDuplicate
+		}
+	}
+
+	message.Sequence = ch.sequence + 1
+
+	if ch.Store != nil {
+		if err := ch.Store.Append(message); err != nil {
+			ch.Unlock()
+			return message, err
+		}
+	}
+
+	ch.sequence = message.Sequence
+
+	if deduplicate {
+		ch.remember(message, now)
+	}
+
+	if message.Retain {
+		ch.retain(message)
+	}
+
+	ch.record(message)
+	ch.topics.match(message.Topic, matched)
+	ch.Unlock()
+
+	// Queue the message outside of the lock so registrations are never held up by delivery,
+	// the order lock keeps the next publish from overtaking it
+	for sub := range matched {
+		if !sub.deliver(message) {
+			ch.remove(sub)
 		}
+	}
+
+	return message, nil
+}
+
+// SendMessage publishes a plain text message to all matching channels registered to the topic
+func (ch *Hub) SendMessage(message string, topic string) {
+	ch.Publish(NewTextMessage(topic, message))
+}
 
-		// Send the message
-		*channel <- message
+// RegisterChannel registers the specified channel with the specified topic filters, it receives
+// the payload of each message as a string. See RegisterMessageChannel for the filters and options.
+func (ch *Hub) RegisterChannel(channel *chan string, topics []string, options ...Option) (err error) {
+	if channel == nil {
+		return errors.New("no channel specified")
 	}
+
+	return ch.registerChannel(channel, topics, options, func(sub *subscriber) {
+		sub.forwardStrings(channel)
+	})
+}
+
+// DeregisterChannel removes the channel from the list of channels to write to.
+// Once it returns, the Hub no longer writes to the channel and it is safe to close.
+func (ch *Hub) DeregisterChannel(channel *chan string) {
+	ch.deregisterChannel(channel)
 }
 
-// RegisterChannel registers the specified channel with the specified topics
-func (ch *Hub) RegisterChannel(channel *chan string, topics []string) (err error) {
-	// Validate params
+// RegisterMessageChannel registers the specified channel with the specified topic filters.
+// Filters may use the "+" and "#" wildcards, see ValidateTopicFilter.
+// Options such as QueueSize, Backpressure and From only apply the first time a channel is
+// registered, and the Disconnect policy is refused.
+func (ch *Hub) RegisterMessageChannel(channel *chan Message, topics []string, options ...Option) (err error) {
 	if channel == nil {
 		return errors.New("no channel specified")
 	}
 
-	if topics == nil || len(topics) == 0 {
-		return errors.New("no topics specified")
+	return ch.registerChannel(channel, topics, options, func(sub *subscriber) {
+		sub.forwardTo(channel)
+	})
+}
+
+// DeregisterMessageChannel removes the channel from the list of channels to write to.
+// Once it returns, the Hub no longer writes to the channel and it is safe to close.
+func (ch *Hub) DeregisterMessageChannel(channel *chan Message) {
+	ch.deregisterChannel(channel)
+}
+
+// registerChannel adds topics to the channel's subscriber, creating it and starting its
+// forwarder on first use
+func (ch *Hub) registerChannel(channel interface{}, topics []string, options []Option, forward func(*subscriber)) error {
+	if err := validateTopicFilters(topics); err != nil {
+		return err
+	}
+
+	// The Hub does not own the channel, so its consumer could not learn it was disconnected
+	config := newSubscriptionConfig(options)
+	if config.policy == Disconnect {
+		return errors.New("registered channels can not use the Disconnect policy, use Subscribe")
 	}
 
 	// Maps are not thread-safe, let's make sure we are!
 	ch.Lock()
 	defer ch.Unlock()
 
-	// Initialize channels map if it has not already been init
-	if ch.channels == nil {
-		ch.channels = make(map[*chan string]map[string]struct{})
+	ch.init()
+
+	// If channel is already initialized, only register the new topics on it
+	if sub, ok := ch.channels[channel]; ok {
+		ch.register(sub, topics)
+		return nil
 	}
 
-	// If channel is not already initialized, initialize topic list for channel
-	if _, ok := ch.channels[channel]; !ok {
-		ch.channels[channel] = make(map[string]struct{})
+	// Otherwise create its queue and start delivering to it
+	sub := ch.subscribe(config, topics)
+	sub.channel = channel
+	forward(sub)
+
+	ch.channels[channel] = sub
+
+	return nil
+}
+
+func (ch *Hub) deregisterChannel(channel interface{}) {
+	ch.Lock()
+	sub, ok := ch.channels[channel]
+	ch.Unlock()
+
+	if ok {
+		ch.remove(sub)
 	}
+}
 
-	// Register each topic on the channel
-	for _, topic := range topics {
-		ch.channels[channel][topic] = struct{}{}
+// Stats reports the queue depth and dropped message count of every registered subscriber
+func (ch *Hub) Stats() []SubscriberStats {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	stats := make([]SubscriberStats, 0, len(ch.subscribers))
+	for sub := range ch.subscribers {
+		stats = append(stats, sub.stats())
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+
+	return stats
+}
+
+// Drain waits until every message published so far has been taken by its subscribers, or ctx
+// ends. Publishers should be stopped first, or Drain may never find the Hub idle. A subscriber
+// that stops reading without unsubscribing holds Drain until ctx ends.
+func (ch *Hub) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for !ch.idle() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	return nil
 }
 
-// DeregisterChannel removes the channel from the list of channels to write to
-func (ch *Hub) DeregisterChannel(channel *chan string) {
+// idle reports whether no message is being published or waiting in a subscriber's queue
+func (ch *Hub) idle() bool {
+	if atomic.LoadInt32(&ch.publishing) > 0 {
+		return false
+	}
+
+	ch.RLock()
+	defer ch.RUnlock()
+
+	for sub := range ch.subscribers {
+		if !sub.idle() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Sequence returns the sequence number of the last message published, zero if there is none
+func (ch *Hub) Sequence() uint64 {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	return ch.sequence
+}
+
+// After returns the offset of the messages published after the sequence. A sequence ahead of the
+// Hub, which a client may hold across a restart without a Store, starts from Earliest instead.
+func (ch *Hub) After(sequence uint64) Offset {
+	if sequence > ch.Sequence() {
+		return Earliest()
+	}
+
+	return FromSequence(sequence + 1)
+}
+
+// History returns the messages still held in history for topics matching any of the filters,
+// starting from the offset, in the order they were published
+func (ch *Hub) History(filters []string, from Offset) []Message {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	return ch.matchHistory(filters, from)
+}
+
+// record appends the message to the history of its topic, forgetting the topic published to
+// longest ago when a new topic would exceed HistoryTopics. The lock must be held.
+func (ch *Hub) record(message Message) {
+	if ch.HistorySize < 1 {
+		return
+	}
+
+	r, ok := ch.history[message.Topic]
+	if !ok {
+		limit := ch.HistoryTopics
+		if limit < 1 {
+			limit = defaultHistoryTopics
+		}
+
+		if len(ch.history) >= limit {
+			oldest := ch.historyAge.Remove(ch.historyAge.Front()).(string)
+			delete(ch.history, oldest)
+		}
+
+		r = newRing(ch.HistorySize)
+		r.age = ch.historyAge.PushBack(message.Topic)
+		ch.history[message.Topic] = r
+	} else {
+		ch.historyAge.MoveToBack(r.age)
+	}
+
+	r.push(message)
+}
+
+// matchHistory returns the messages held in history matching the filters and offset in sequence order
+func (ch *Hub) matchHistory(filters []string, from Offset) []Message {
+	messages := make([]Message, 0)
+	if from.IsLatest() {
+		return messages
+	}
+
+	for topic, r := range ch.history {
+		if !matchAny(filters, topic) {
+			continue
+		}
+
+		r.each(func(message Message) {
+			if from.includes(message) {
+				messages = append(messages, message)
+			}
+		})
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Sequence < messages[j].Sequence })
+
+	return messages
+}
+
+// Retained returns the retained message of every topic matching the filter in the order they were published
+func (ch *Hub) Retained(filter string) []Message {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	return ch.matchRetained(func(topic string) bool { return MatchTopic(filter, topic) })
+}
+
+// retain sets or clears the retained message of the message's topic, the lock must be held
+func (ch *Hub) retain(message Message) {
+	if len(message.Payload) == 0 {
+		delete(ch.retained, message.Topic)
+		return
+	}
+
+	ch.retained[message.Topic] = message
+}
+
+// matchRetained returns the retained messages with topics accepted by match in sequence order
+func (ch *Hub) matchRetained(match func(topic string) bool) []Message {
+	messages := make([]Message, 0)
+	for topic, message := range ch.retained {
+		if match(topic) {
+			messages = append(messages, message)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Sequence < messages[j].Sequence })
+
+	return messages
+}
+
+// init initializes the Hub's maps if they have not already been init, the lock must be held
+func (ch *Hub) init() {
+	if ch.subscribers != nil {
+		return
+	}
+
+	ch.subscribers = make(map[*subscriber]struct{})
+	ch.channels = make(map[interface{}]*subscriber)
+	ch.topics = newTopicNode()
+	ch.retained = make(map[string]Message)
+	ch.history = make(map[string]*ring)
+	ch.historyAge = list.New()
+	ch.dedup = make(map[dedupKey]published)
+}
+
+// subscribe creates a subscriber for the topics, queueing any history its Offset asks for.
+// The lock must be held.
+func (ch *Hub) subscribe(config subscriptionConfig, topics []string) *subscriber {
+	backlog := ch.matchHistory(topics, config.from)
+
+	sub := newSubscriber(config, len(backlog))
+	for _, message := range backlog {
+		sub.offer(message)
+	}
+
+	ch.register(sub, topics)
+
+	return sub
+}
+
+// register adds the topic filters to the subscriber and the topic trie, then hands a subscriber
+// starting from the Latest offset the retained messages it did not already match.
+// The lock must be held.
+func (ch *Hub) register(sub *subscriber, topics []string) {
+	ch.subscribers[sub] = struct{}{}
+
+	added := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if _, ok := sub.topics[topic]; ok {
+			continue
+		}
+
+		added = append(added, topic)
+	}
+
+	retained := make([]Message, 0)
+	if sub.config.from.IsLatest() {
+		existing := sub.filters()
+		retained = ch.matchRetained(func(topic string) bool {
+			return matchAny(added, topic) && !matchAny(existing, topic)
+		})
+	}
+
+	for _, topic := range added {
+		sub.topics[topic] = struct{}{}
+		ch.topics.add(topic, sub)
+	}
+
+	for _, message := range retained {
+		message.Retain = true
+		sub.offer(message)
+	}
+}
+
+// unregister removes the topic filters from the subscriber and the topic trie, the lock must be held
+func (ch *Hub) unregister(sub *subscriber, topics []string) {
+	for _, topic := range topics {
+		if _, ok := sub.topics[topic]; !ok {
+			continue
+		}
+
+		delete(sub.topics, topic)
+		ch.topics.remove(topic, sub)
+	}
+
+	// "*" and "#" share a trie node, so put back any remaining filter the removal may have cleared
+	for topic := range sub.topics {
+		ch.topics.add(topic, sub)
+	}
+}
+
+// remove deregisters the subscriber, if it is still registered, and stops its delivery
+func (ch *Hub) remove(sub *subscriber) {
 	ch.Lock()
-	defer ch.Unlock()
+	if _, ok := ch.subscribers[sub]; ok {
+		delete(ch.subscribers, sub)
+
+		if sub.channel != nil && ch.channels[sub.channel] == sub {
+			delete(ch.channels, sub.channel)
+		}
+
+		for topic := range sub.topics {
+			ch.topics.remove(topic, sub)
+		}
+	}
+	ch.Unlock()
+
+	sub.close()
+}
+
+func matchAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if MatchTopic(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
 
-	if _, ok := ch.channels[channel]; ok {
-		delete(ch.channels, channel)
+func validateTopicFilters(topics []string) error {
+	if topics == nil || len(topics) == 0 {
+		return errors.New("no topics specified")
 	}
+
+	for _, topic := range topics {
+		if err := ValidateTopicFilter(topic); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -1,34 +1,62 @@
 package channel
 
-import "testing"
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
 
-func TestRegisterChannelRequiresChannel(t *testing.T) {
+func TestRegisterMessageChannelRequiresChannel(t *testing.T) {
 	var ch Hub
 
-	err := ch.RegisterChannel(nil, []string{"*"})
+	err := ch.RegisterMessageChannel(nil, []string{"*"})
 
 	if err == nil || err.Error() != "no channel specified" {
-		t.Errorf("RegisterChannel(nil, []string{\"*\"}) = %v, want %v", err, "no channel specified")
+		t.Errorf("RegisterMessageChannel(nil, []string{\"*\"}) = %v, want %v", err, "no channel specified")
 	}
 }
 
-func TestRegisterChannelRequiresTopic(t *testing.T) {
+func TestRegisterMessageChannelRequiresTopic(t *testing.T) {
 	var ch Hub
 
-	c := make(chan string)
+	c := make(chan Message)
 
-	err := ch.RegisterChannel(&c, nil)
+	err := ch.RegisterMessageChannel(&c, nil)
 
 	if err == nil || err.Error() != "no topics specified" {
-		t.Errorf("RegisterChannel(c, nil) = %v, want %v", err, "no topics specified")
+		t.Errorf("RegisterMessageChannel(c, nil) = %v, want %v", err, "no topics specified")
+	}
+}
+
+func TestRegisterChannelReceivesPayloadStrings(t *testing.T) {
+	var ch Hub
+
+	c := make(chan string, 1)
+	if err := ch.RegisterChannel(&c, []string{"*"}); err != nil {
+		t.Fatalf("RegisterChannel(c, []string{\"*\"}) = %v, want nil", err)
+	}
+
+	ch.SendMessage("howdy doody", "c1")
+
+	if received := <-c; received != "howdy doody" {
+		t.Errorf("SendMessage(); Received = %v, want howdy doody", received)
+	}
+
+	ch.DeregisterChannel(&c)
+	ch.SendMessage("goodbye", "c1")
+
+	if len(c) != 0 {
+		t.Errorf("SendMessage() after DeregisterChannel(); Received = %v, want nothing", <-c)
 	}
 }
 
 func TestSendMessageSendsToRegisteredChannel(t *testing.T) {
 	var ch Hub
 
-	c := make(chan string)
-	ch.RegisterChannel(&c, []string{"*"})
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"*"})
 
 	expected := "howdy doody"
 
@@ -36,18 +64,18 @@ func TestSendMessageSendsToRegisteredChannel(t *testing.T) {
 		ch.SendMessage(expected, "c1")
 	}()
 
-	received := <-c
+	received := (<-c).String()
 
 	if received != expected {
-		t.Errorf("SendMessage(\"%v\", \"*\"); Received = %v, want = %v", expected, received, expected)
+		t.Errorf("SendMessage(\"%v\", \"c1\"); Received = %v, want = %v", expected, received, expected)
 	}
 }
 
 func TestSendMessageSendsToMatchedTopic(t *testing.T) {
 	var ch Hub
 
-	c := make(chan string)
-	ch.RegisterChannel(&c, []string{"c1"})
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"c1"})
 
 	expected := "howdy doody"
 
@@ -55,7 +83,7 @@ func TestSendMessageSendsToMatchedTopic(t *testing.T) {
 		ch.SendMessage(expected, "c1")
 	}()
 
-	received := <-c
+	received := (<-c).String()
 
 	if received != expected {
 		t.Errorf("SendMessage(\"%v\", \"c1\"); Received = %v, want = %v", expected, received, expected)
@@ -65,37 +93,304 @@ func TestSendMessageSendsToMatchedTopic(t *testing.T) {
 func TestSendMessageDoesNotSendToUnmatchedTopic(t *testing.T) {
 	var ch Hub
 
-	c := make(chan string)
-	ch.RegisterChannel(&c, []string{"c3"})
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"c3"})
 
 	go func() {
 		ch.SendMessage("howdy doody", "c1")
 		close(c)
 	}()
 
-	received := <-c
+	received := (<-c).String()
 
 	if received != "" {
 		t.Errorf("SendMessage(\"howdy doody\", \"c1\"); Received = %v, want = \"\"", received)
 	}
 }
 
-func TestDeregisterChannelRemovesChannelFromReceivingMessages(t *testing.T) {
+func TestDeregisterMessageChannelRemovesChannelFromReceivingMessages(t *testing.T) {
 	var ch Hub
 
-	c := make(chan string)
+	c := make(chan Message)
 
-	ch.RegisterChannel(&c, []string{"c1"})
-	ch.DeregisterChannel(&c)
+	ch.RegisterMessageChannel(&c, []string{"c1"})
+	ch.DeregisterMessageChannel(&c)
 
 	go func() {
 		ch.SendMessage("howdy doody", "c1")
 		close(c)
 	}()
 
-	received := <-c
+	received := (<-c).String()
 
 	if received != "" {
 		t.Errorf("SendMessage(\"howdy doody\", \"c1\"); Received = %v, want = \"\"", received)
 	}
 }
+
+func TestPublishStampsEnvelope(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"c1"})
+
+	go func() {
+		ch.Publish(Message{Topic: "c1", Payload: []byte("{}"), ContentType: "application/json"})
+	}()
+
+	received := <-c
+
+	if received.ID == "" {
+		t.Errorf("Publish(); Received ID = \"\", want generated ID")
+	}
+
+	if received.Timestamp.IsZero() {
+		t.Errorf("Publish(); Received Timestamp = zero, want publish time")
+	}
+
+	if received.Topic != "c1" || received.ContentType != "application/json" {
+		t.Errorf("Publish(); Received = %v/%v, want = c1/application/json", received.Topic, received.ContentType)
+	}
+}
+
+func TestSendMessageDoesNotBlockOnSlowSubscriber(t *testing.T) {
+	var ch Hub
+
+	slow := make(chan Message)
+	ch.RegisterMessageChannel(&slow, []string{"c1"}, QueueSize(1))
+
+	fast := make(chan Message, 10)
+	ch.RegisterMessageChannel(&fast, []string{"c1"}, QueueSize(10))
+
+	sent := make(chan struct{})
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			ch.SendMessage("howdy doody", "c1")
+		}
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("SendMessage() blocked on a subscriber that is not reading")
+	}
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-fast:
+		case <-time.After(time.Second):
+			t.Fatalf("fast subscriber received %v messages, want 10", i)
+		}
+	}
+}
+
+func TestQueueSizeBuffersMessagesForSubscriber(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"c1"}, QueueSize(3))
+
+	for _, m := range []string{"one", "two", "three"} {
+		ch.SendMessage(m, "c1")
+	}
+
+	for _, expected := range []string{"one", "two", "three"} {
+		received := (<-c).String()
+
+		if received != expected {
+			t.Errorf("QueueSize(3); Received = %v, want = %v", received, expected)
+		}
+	}
+}
+
+// waitForForwarder waits until the forwarder of the only registered channel has taken the
+// queued message and is blocked handing it to the channel
+func waitForForwarder(ch *Hub) {
+	for ch.Stats()[0].Queued != 0 {
+		runtime.Gosched()
+	}
+}
+
+func TestDropNewestCountsDroppedMessages(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"c1"}, QueueSize(1), Name("slow"))
+
+	// The forwarder holds one message and the queue holds another, everything after is dropped
+	ch.SendMessage("howdy doody", "c1")
+	waitForForwarder(&ch)
+
+	for i := 0; i < 4; i++ {
+		ch.SendMessage("howdy doody", "c1")
+	}
+
+	stats := ch.Stats()
+
+	if len(stats) != 1 || stats[0].Name != "slow" || stats[0].Dropped != 3 {
+		t.Errorf("Stats() = %+v, want 1 subscriber named slow with 3 dropped", stats)
+	}
+}
+
+func TestDropOldestKeepsNewestMessages(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"c1"}, QueueSize(2), Backpressure(DropOldest))
+
+	ch.SendMessage("one", "c1")
+	waitForForwarder(&ch)
+
+	for _, m := range []string{"two", "three", "four"} {
+		ch.SendMessage(m, "c1")
+	}
+
+	for _, expected := range []string{"one", "three", "four"} {
+		received := (<-c).String()
+
+		if received != expected {
+			t.Errorf("Backpressure(DropOldest); Received = %v, want = %v", received, expected)
+		}
+	}
+}
+
+func TestBlockWaitsForSubscriber(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"c1"}, QueueSize(1), Backpressure(Block))
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			ch.SendMessage("howdy doody", "c1")
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			t.Fatalf("Backpressure(Block); received %v messages, want 5", i)
+		}
+	}
+
+	if dropped := ch.Stats()[0].Dropped; dropped != 0 {
+		t.Errorf("Backpressure(Block); Dropped = %v, want 0", dropped)
+	}
+}
+
+func TestConcurrentPublishersDeliverInSequenceOrder(t *testing.T) {
+	var ch Hub
+
+	const publishers, messages = 16, 500
+
+	s, _ := ch.SubscribeWith(context.Background(), []string{"#"}, QueueSize(publishers*messages))
+	defer s.Unsubscribe()
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < messages; i++ {
+				ch.SendMessage("reading", "sensors/temp")
+			}
+		}()
+	}
+	wg.Wait()
+
+	var last uint64
+	for i := 0; i < publishers*messages; i++ {
+		received := <-s.C
+
+		if received.Sequence != last+1 {
+			t.Fatalf("Sequence = %v after %v, want %v", received.Sequence, last, last+1)
+		}
+
+		last = received.Sequence
+	}
+}
+
+func TestDisconnectRemovesSlowSubscriber(t *testing.T) {
+	var ch Hub
+
+	s, _ := ch.SubscribeWith(context.Background(), []string{"c1"}, QueueSize(1), Backpressure(Disconnect))
+
+	for i := 0; i < 2; i++ {
+		ch.SendMessage("howdy doody", "c1")
+	}
+
+	if stats := ch.Stats(); len(stats) != 0 {
+		t.Errorf("Backpressure(Disconnect); Stats() = %+v, want no subscribers", stats)
+	}
+
+	<-s.C
+	if _, ok := <-s.C; ok {
+		t.Errorf("Backpressure(Disconnect); C is open, want closed after the queued message")
+	}
+}
+
+func TestRegisterChannelRefusesDisconnect(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message)
+	if err := ch.RegisterMessageChannel(&c, []string{"c1"}, Backpressure(Disconnect)); err == nil {
+		t.Errorf("RegisterMessageChannel(c, Backpressure(Disconnect)) = nil, want error")
+	}
+}
+
+func TestDrainWaitsForRegisteredChannels(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message)
+	ch.RegisterMessageChannel(&c, []string{"c1"}, QueueSize(3))
+
+	for _, m := range []string{"one", "two"} {
+		ch.SendMessage(m, "c1")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := ch.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain() with queued messages = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	drained := make(chan error)
+	go func() { drained <- ch.Drain(context.Background()) }()
+
+	<-c
+	<-c
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("Drain() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Drain() did not return once the messages were received")
+	}
+}
+
+func TestDrainWaitsForSubscriptions(t *testing.T) {
+	var ch Hub
+
+	s, _ := ch.Subscribe(context.Background(), "c1")
+	ch.SendMessage("one", "c1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := ch.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain() with a queued message = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	<-s.C
+
+	if err := ch.Drain(context.Background()); err != nil {
+		t.Errorf("Drain() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,86 @@
+package channel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// TextContentType is the content type assigned to messages published as strings
+const TextContentType = "text/plain; charset=utf-8"
+
+// Message is the envelope that flows through the Hub to every subscriber
+type Message struct {
+	// Sequence is assigned by the Hub when the message is published and increases with every message
+	Sequence uint64
+
+	ID          string
+	Topic       string
+	Timestamp   time.Time
+	Headers     map[string]string
+	Payload     []byte
+	ContentType string
+
+	// Publisher identifies who published the message, e.g. an API key, and scopes its ID for
+	// deduplication: only a publisher repeating an ID on the same topic is a duplicate
+	Publisher string
+
+	// Retain asks the Hub to keep the message as the last value of its topic and hand it to
+	// every new subscriber. Publishing a retained message with an empty payload clears the value.
+	Retain bool
+}
+
+// KeyPublisher names a publisher by the API key it presented, see Message.Publisher
+func KeyPublisher(name string) string {
+	return "key " + name
+}
+
+// AddressPublisher names a publisher without a key by the host of its remote address, so the
+// port it connects from does not matter, see Message.Publisher
+func AddressPublisher(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	return "address " + host
+}
+
+// NewTextMessage creates a plain text message for the specified topic
+func NewTextMessage(topic string, text string) Message {
+	return Message{
+		Topic:       topic,
+		Payload:     []byte(text),
+		ContentType: TextContentType,
+	}
+}
+
+// String returns the payload of the message as a string
+func (m Message) String() string {
+	return string(m.Payload)
+}
+
+// stamp fills in the ID and Timestamp of the message if they were not provided
+func (m Message) stamp() Message {
+	if m.ID == "" {
+		m.ID = newMessageID()
+	}
+
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now().UTC()
+	}
+
+	return m
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+
+	// crypto/rand only fails when the OS entropy source is unavailable
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,65 @@
+package channel
+
+import "time"
+
+type offsetKind int
+
+const (
+	latestOffset offsetKind = iota
+	earliestOffset
+	sequenceOffset
+	timeOffset
+)
+
+// Offset selects where in the Hub's history a subscription starts
+type Offset struct {
+	kind     offsetKind
+	sequence uint64
+	time     time.Time
+}
+
+// Latest starts a subscription with the next published message, after any retained messages
+func Latest() Offset {
+	return Offset{kind: latestOffset}
+}
+
+// Earliest starts a subscription with the oldest message still held in the Hub's history
+func Earliest() Offset {
+	return Offset{kind: earliestOffset}
+}
+
+// FromSequence starts a subscription with the first message at or after the sequence number
+func FromSequence(sequence uint64) Offset {
+	return Offset{kind: sequenceOffset, sequence: sequence}
+}
+
+// FromTime starts a subscription with the first message published at or after t
+func FromTime(t time.Time) Offset {
+	return Offset{kind: timeOffset, time: t}
+}
+
+// IsLatest reports whether the offset skips the Hub's history
+func (o Offset) IsLatest() bool {
+	return o.kind == latestOffset
+}
+
+// includes reports whether the message is at or after the offset
+func (o Offset) includes(message Message) bool {
+	switch o.kind {
+	case earliestOffset:
+		return true
+	case sequenceOffset:
+		return message.Sequence >= o.sequence
+	case timeOffset:
+		return !message.Timestamp.Before(o.time)
+	}
+
+	return false
+}
+
+// From sets the Offset a subscription starts from, the default is Latest
+func From(offset Offset) Option {
+	return func(c *subscriptionConfig) {
+		c.from = offset
+	}
+}
@@ -0,0 +1,75 @@
+package channel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscribeReceivesRetainedMessage(t *testing.T) {
+	var ch Hub
+
+	ch.Publish(Message{Topic: "sensors/temp", Payload: []byte("21.5"), Retain: true})
+	ch.Publish(Message{Topic: "sensors/humidity", Payload: []byte("40"), Retain: true})
+	ch.SendMessage("not retained", "sensors/pressure")
+
+	s, _ := ch.Subscribe(context.Background(), "sensors/#")
+	defer s.Unsubscribe()
+
+	for _, expected := range []string{"21.5", "40"} {
+		select {
+		case received := <-s.C:
+			if received.String() != expected || !received.Retain {
+				t.Errorf("Subscribe(); Received = %v (retain %v), want retained %v", received, received.Retain, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Subscribe(); received nothing, want retained %v", expected)
+		}
+	}
+
+	select {
+	case received := <-s.C:
+		t.Errorf("Subscribe(); Received = %v, want only retained messages", received)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRetainedMessageIsReplacedAndCleared(t *testing.T) {
+	var ch Hub
+
+	ch.Publish(Message{Topic: "sensors/temp", Payload: []byte("21.5"), Retain: true})
+	ch.Publish(Message{Topic: "sensors/temp", Payload: []byte("22.0"), Retain: true})
+
+	if retained := ch.Retained("sensors/temp"); len(retained) != 1 || retained[0].String() != "22.0" {
+		t.Errorf("Retained(\"sensors/temp\") = %v, want [22.0]", retained)
+	}
+
+	ch.Publish(Message{Topic: "sensors/temp", Retain: true})
+
+	if retained := ch.Retained("#"); len(retained) != 0 {
+		t.Errorf("Retained(\"#\") after clearing = %v, want none", retained)
+	}
+}
+
+func TestRegisterMessageChannelReceivesRetainedMessageForNewTopics(t *testing.T) {
+	var ch Hub
+
+	ch.Publish(Message{Topic: "c1", Payload: []byte("one"), Retain: true})
+	ch.Publish(Message{Topic: "c2", Payload: []byte("two"), Retain: true})
+
+	c := make(chan Message, 3)
+	ch.RegisterMessageChannel(&c, []string{"c1"})
+	ch.RegisterMessageChannel(&c, []string{"c1", "c2"})
+
+	time.Sleep(10 * time.Millisecond)
+
+	if len(c) != 2 {
+		t.Fatalf("RegisterMessageChannel(); Received %v retained messages, want 2", len(c))
+	}
+
+	for _, expected := range []string{"one", "two"} {
+		if received := (<-c).String(); received != expected {
+			t.Errorf("RegisterMessageChannel(); Received = %v, want %v", received, expected)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package channel
+
+import "container/list"
+
+// ring keeps the most recent messages published to a topic, oldest first
+type ring struct {
+	messages []Message
+	start    int
+	count    int
+
+	// age is the topic's place in the Hub's history, from published to longest ago
+	age *list.Element
+}
+
+func newRing(size int) *ring {
+	return &ring{messages: make([]Message, size)}
+}
+
+// push appends the message, overwriting the oldest message once the ring is full
+func (r *ring) push(message Message) {
+	end := (r.start + r.count) % len(r.messages)
+	r.messages[end] = message
+
+	if r.count < len(r.messages) {
+		r.count++
+	} else {
+		r.start = (r.start + 1) % len(r.messages)
+	}
+}
+
+// each calls fn with every message in the ring, oldest first
+func (r *ring) each(fn func(Message)) {
+	for i := 0; i < r.count; i++ {
+		fn(r.messages[(r.start+i)%len(r.messages)])
+	}
+}
@@ -0,0 +1,38 @@
+package channel
+
+// Store persists published messages so the Hub's history and retained values survive restarts
+type Store interface {
+	// Append durably records a published message, it is called in sequence order
+	Append(message Message) error
+	// Replay calls fn with every stored message in the order they were appended
+	Replay(fn func(Message) error) error
+	// Close flushes and releases the store
+	Close() error
+}
+
+// Restore loads the messages held by the Store into history and retained values and continues
+// sequencing after the last stored message. It should be called before the Hub is used.
+func (ch *Hub) Restore() error {
+	if ch.Store == nil {
+		return nil
+	}
+
+	ch.Lock()
+	defer ch.Unlock()
+
+	ch.init()
+
+	return ch.Store.Replay(func(message Message) error {
+		if message.Sequence > ch.sequence {
+			ch.sequence = message.Sequence
+		}
+
+		if message.Retain {
+			ch.retain(message)
+		}
+
+		ch.record(message)
+
+		return nil
+	})
+}
@@ -0,0 +1,289 @@
+package channel
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultQueueSize is the number of messages buffered for a subscriber when no QueueSize option is given
+const DefaultQueueSize = 64
+
+// Option configures a subscription when it is registered with the Hub
+type Option func(*subscriptionConfig)
+
+type subscriptionConfig struct {
+	name      string
+	queueSize int
+	policy    Policy
+	from      Offset
+}
+
+// Policy decides what happens when a subscriber's queue is full
+type Policy int
+
+const (
+	// DropNewest discards the message being published
+	DropNewest Policy = iota
+	// DropOldest discards the oldest queued message to make room for the one being published
+	DropOldest
+	// Block makes the publisher wait until the subscriber has room
+	Block
+	// Disconnect removes the subscriber from the Hub and closes its Subscription's C. Registered
+	// channels are not closed, so they can not use it.
+	Disconnect
+)
+
+func (p Policy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case Disconnect:
+		return "disconnect"
+	}
+
+	return "unknown"
+}
+
+// SubscriberStats reports how a subscriber is keeping up with the Hub
+type SubscriberStats struct {
+	Name      string
+	Topics    []string
+	Policy    Policy
+	QueueSize int
+	Queued    int
+	Dropped   uint64
+}
+
+// Name labels the subscriber in SubscriberStats
+func Name(name string) Option {
+	return func(c *subscriptionConfig) {
+		c.name = name
+	}
+}
+
+// Backpressure sets the Policy applied when the subscriber's queue is full
+func Backpressure(policy Policy) Option {
+	return func(c *subscriptionConfig) {
+		c.policy = policy
+	}
+}
+
+// QueueSize sets the number of messages buffered for the subscriber before its Policy applies
+func QueueSize(size int) Option {
+	return func(c *subscriptionConfig) {
+		c.queueSize = size
+	}
+}
+
+func newSubscriptionConfig(options []Option) subscriptionConfig {
+	config := subscriptionConfig{queueSize: DefaultQueueSize}
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	if config.queueSize < 1 {
+		config.queueSize = 1
+	}
+
+	return config
+}
+
+// subscriber buffers messages for a single subscriber between the publisher and its consumer.
+// Subscriptions read the queue directly, registered channels are fed from it by a forwarder.
+type subscriber struct {
+	sync.RWMutex
+	dropped uint64
+	// pending counts queued messages a forwarder has yet to hand to its channel
+	pending int64
+
+	config    subscriptionConfig
+	channel   interface{}
+	topics    map[string]struct{}
+	queue     chan Message
+	done      chan struct{}
+	doneOnce  sync.Once
+	forwarded chan struct{}
+	closed    bool
+}
+
+// newSubscriber creates a subscriber with room for backlog on top of its configured queue size
+func newSubscriber(config subscriptionConfig, backlog int) *subscriber {
+	return &subscriber{
+		config: config,
+		topics: make(map[string]struct{}),
+		queue:  make(chan Message, config.queueSize+backlog),
+		done:   make(chan struct{}),
+	}
+}
+
+// deliver queues the message, applying the subscription's Policy if the queue is full.
+// It returns false when the subscriber should be disconnected.
+func (s *subscriber) deliver(message Message) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.closed {
+		return true
+	}
+
+	select {
+	case s.queue <- message:
+		atomic.AddInt64(&s.pending, 1)
+		return true
+	default:
+	}
+
+	switch s.config.policy {
+	case Block:
+		select {
+		case s.queue <- message:
+			atomic.AddInt64(&s.pending, 1)
+		case <-s.done:
+		}
+	case DropOldest:
+		for {
+			select {
+			case <-s.queue:
+				atomic.AddUint64(&s.dropped, 1)
+				atomic.AddInt64(&s.pending, -1)
+			default:
+			}
+
+			select {
+			case s.queue <- message:
+				atomic.AddInt64(&s.pending, 1)
+				return true
+			default:
+			}
+		}
+	case Disconnect:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+
+	return true
+}
+
+// offer queues the message only if there is room, it never blocks regardless of Policy
+func (s *subscriber) offer(message Message) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.queue <- message:
+		atomic.AddInt64(&s.pending, 1)
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// idle reports whether the subscriber's consumer has taken every queued message. A forwarder is
+// only idle once it has handed its last message to the channel.
+func (s *subscriber) idle() bool {
+	if s.forwarded != nil {
+		return atomic.LoadInt64(&s.pending) == 0
+	}
+
+	return len(s.queue) == 0
+}
+
+// filters returns the subscriber's topic filters in order
+func (s *subscriber) filters() []string {
+	topics := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return topics
+}
+
+func (s *subscriber) stats() SubscriberStats {
+	return SubscriberStats{
+		Name:      s.config.name,
+		Topics:    s.filters(),
+		Policy:    s.config.policy,
+		QueueSize: cap(s.queue),
+		Queued:    len(s.queue),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+	}
+}
+
+// forwardTo starts draining the queue into the registered channel
+func (s *subscriber) forwardTo(channel *chan Message) {
+	out := *channel
+
+	s.forward(func(message Message) bool {
+		select {
+		case out <- message:
+			return true
+		case <-s.done:
+			return false
+		}
+	})
+}
+
+// forwardStrings starts draining the payloads of the queued messages into the registered channel
+func (s *subscriber) forwardStrings(channel *chan string) {
+	out := *channel
+
+	s.forward(func(message Message) bool {
+		select {
+		case out <- message.String():
+			return true
+		case <-s.done:
+			return false
+		}
+	})
+}
+
+// forward starts handing queued messages to send until the subscriber is closed or send fails
+func (s *subscriber) forward(send func(Message) bool) {
+	s.forwarded = make(chan struct{})
+
+	go func() {
+		defer close(s.forwarded)
+
+		for {
+			select {
+			case message, ok := <-s.queue:
+				if !ok || !send(message) {
+					return
+				}
+
+				atomic.AddInt64(&s.pending, -1)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// close stops delivery, closes the queue and waits for any forwarder to let go of its channel
+func (s *subscriber) close() {
+	// Closing done first releases any publisher blocked in deliver before we wait for the lock
+	s.doneOnce.Do(func() { close(s.done) })
+
+	s.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.Unlock()
+
+	if s.forwarded != nil {
+		<-s.forwarded
+	}
+}
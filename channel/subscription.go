@@ -0,0 +1,100 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Subscription receives the messages published to its topics until it is unsubscribed
+type Subscription struct {
+	// C receives the messages matching the subscription's topics. It is closed once the
+	// subscription ends, whether by Unsubscribe, context cancellation or the Disconnect policy.
+	C <-chan Message
+
+	hub *Hub
+	sub *subscriber
+}
+
+// Subscribe registers a new subscription to the topic filters with the default options.
+// The subscription ends when ctx is cancelled or Unsubscribe is called.
+func (ch *Hub) Subscribe(ctx context.Context, topics ...string) (*Subscription, error) {
+	return ch.SubscribeWith(ctx, topics)
+}
+
+// SubscribeWith registers a new subscription to the topic filters configured by options.
+// The subscription ends when ctx is cancelled or Unsubscribe is called.
+func (ch *Hub) SubscribeWith(ctx context.Context, topics []string, options ...Option) (*Subscription, error) {
+	if err := validateTopicFilters(topics); err != nil {
+		return nil, err
+	}
+
+	ch.Lock()
+	ch.init()
+	sub := ch.subscribe(newSubscriptionConfig(options), topics)
+	ch.Unlock()
+
+	s := &Subscription{C: sub.queue, hub: ch, sub: sub}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Unsubscribe()
+		case <-sub.done:
+		}
+	}()
+
+	return s, nil
+}
+
+// Unsubscribe ends the subscription and closes C. It is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.hub.remove(s.sub)
+}
+
+// Done is closed when the subscription ends
+func (s *Subscription) Done() <-chan struct{} {
+	return s.sub.done
+}
+
+// Dropped reports the number of messages discarded because the subscription fell behind
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.sub.dropped)
+}
+
+// AddTopics adds topic filters to the subscription, handing it the retained values of the new topics
+func (s *Subscription) AddTopics(topics ...string) error {
+	if err := validateTopicFilters(topics); err != nil {
+		return err
+	}
+
+	s.hub.Lock()
+	defer s.hub.Unlock()
+
+	if _, ok := s.hub.subscribers[s.sub]; !ok {
+		return errors.New("subscription has ended")
+	}
+
+	s.hub.register(s.sub, topics)
+
+	return nil
+}
+
+// RemoveTopics removes topic filters from the subscription. A subscription without topics stays
+// open but receives nothing until topics are added again.
+func (s *Subscription) RemoveTopics(topics ...string) {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+
+	if _, ok := s.hub.subscribers[s.sub]; ok {
+		s.hub.unregister(s.sub, topics)
+	}
+}
+
+// Topics returns the subscription's topic filters in order
+func (s *Subscription) Topics() []string {
+	s.hub.RLock()
+	defer s.hub.RUnlock()
+
+	return s.sub.filters()
+}
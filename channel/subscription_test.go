@@ -0,0 +1,128 @@
+package channel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscribeRequiresTopic(t *testing.T) {
+	var ch Hub
+
+	_, err := ch.Subscribe(context.Background())
+
+	if err == nil || err.Error() != "no topics specified" {
+		t.Errorf("Subscribe(ctx) = %v, want %v", err, "no topics specified")
+	}
+}
+
+func TestSubscribeReceivesMatchedTopic(t *testing.T) {
+	var ch Hub
+
+	s, _ := ch.Subscribe(context.Background(), "sensors/+")
+	defer s.Unsubscribe()
+
+	ch.SendMessage("21.5", "sensors/temp")
+
+	select {
+	case received := <-s.C:
+		if received.String() != "21.5" {
+			t.Errorf("Subscribe(ctx, \"sensors/+\"); Received = %v, want 21.5", received)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Subscribe(ctx, \"sensors/+\"); received nothing, want 21.5")
+	}
+}
+
+func TestUnsubscribeClosesChannel(t *testing.T) {
+	var ch Hub
+
+	s, _ := ch.Subscribe(context.Background(), "*")
+	s.Unsubscribe()
+	s.Unsubscribe()
+
+	ch.SendMessage("howdy doody", "c1")
+
+	if received, more := <-s.C; more {
+		t.Errorf("Unsubscribe(); Received = %v, want closed channel", received)
+	}
+
+	if stats := ch.Stats(); len(stats) != 0 {
+		t.Errorf("Unsubscribe(); Stats() = %+v, want no subscribers", stats)
+	}
+}
+
+func TestSubscribeEndsWhenContextIsCancelled(t *testing.T) {
+	var ch Hub
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, _ := ch.Subscribe(ctx, "*")
+	cancel()
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("cancel(); subscription did not end")
+	}
+
+	if _, more := <-s.C; more {
+		t.Errorf("cancel(); C is still open, want closed")
+	}
+}
+
+func TestAddAndRemoveTopics(t *testing.T) {
+	var ch Hub
+
+	s, _ := ch.Subscribe(context.Background(), "c1")
+	defer s.Unsubscribe()
+
+	if err := s.AddTopics("c2", "*"); err != nil {
+		t.Fatalf("AddTopics(\"c2\", \"*\") = %v, want nil", err)
+	}
+
+	s.RemoveTopics("c1", "*")
+
+	if topics := s.Topics(); len(topics) != 1 || topics[0] != "c2" {
+		t.Errorf("Topics() = %v, want [c2]", topics)
+	}
+
+	ch.SendMessage("one", "c1")
+	ch.SendMessage("two", "c2")
+
+	select {
+	case received := <-s.C:
+		if received.String() != "two" {
+			t.Errorf("RemoveTopics(\"c1\", \"*\"); Received = %v, want two", received)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("AddTopics(\"c2\"); received nothing, want two")
+	}
+}
+
+func TestAddTopicsKeepsAliasedFilter(t *testing.T) {
+	var ch Hub
+
+	s, _ := ch.Subscribe(context.Background(), "*", "#")
+	defer s.Unsubscribe()
+
+	s.RemoveTopics("*")
+	ch.SendMessage("howdy doody", "c1")
+
+	select {
+	case <-s.C:
+	case <-time.After(time.Second):
+		t.Errorf("RemoveTopics(\"*\") with \"#\" remaining; received nothing, want howdy doody")
+	}
+}
+
+func TestAddTopicsAfterUnsubscribe(t *testing.T) {
+	var ch Hub
+
+	s, _ := ch.Subscribe(context.Background(), "c1")
+	s.Unsubscribe()
+
+	if err := s.AddTopics("c2"); err == nil {
+		t.Errorf("AddTopics(\"c2\") after Unsubscribe() = nil, want error")
+	}
+}
@@ -0,0 +1,181 @@
+package channel
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Topic filters are made of levels separated by "/". A "+" level matches exactly one topic level
+// and a trailing "#" level matches any number of remaining levels, including none.
+// The filter "*" is kept from earlier releases and is equivalent to "#".
+const (
+	topicSeparator  = "/"
+	singleLevelWild = "+"
+	multiLevelWild  = "#"
+	allTopics       = "*"
+)
+
+// ValidateTopicFilter reports whether the filter can be used to register a subscription
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("invalid topic filter %q: filter is empty", filter)
+	}
+
+	if filter == allTopics {
+		return nil
+	}
+
+	levels := strings.Split(filter, topicSeparator)
+	for i, level := range levels {
+		if level == multiLevelWild && i != len(levels)-1 {
+			return fmt.Errorf("invalid topic filter %q: %q must be the last level", filter, multiLevelWild)
+		}
+
+		if level != singleLevelWild && level != multiLevelWild && strings.ContainsAny(level, singleLevelWild+multiLevelWild) {
+			return fmt.Errorf("invalid topic filter %q: wildcards must occupy an entire level", filter)
+		}
+	}
+
+	return nil
+}
+
+// ValidateTopic reports whether messages can be published to the topic.
+// Published topics name a single destination, so they may not contain wildcards.
+func ValidateTopic(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("invalid topic %q: topic is empty", topic)
+	}
+
+	if topic != allTopics && strings.ContainsAny(topic, singleLevelWild+multiLevelWild) {
+		return fmt.Errorf("invalid topic %q: wildcards are not allowed when publishing", topic)
+	}
+
+	return nil
+}
+
+// MatchTopic reports whether the topic is matched by the filter
+func MatchTopic(filter string, topic string) bool {
+	if filter == allTopics {
+		filter = multiLevelWild
+	}
+
+	filterLevels := strings.Split(filter, topicSeparator)
+	topicLevels := strings.Split(topic, topicSeparator)
+
+	for i, level := range filterLevels {
+		if level == multiLevelWild {
+			return !isSystemTopic(topicLevels, i)
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level == singleLevelWild {
+			if isSystemTopic(topicLevels, i) {
+				return false
+			}
+			continue
+		}
+
+		if level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// isSystemTopic reports whether a wildcard at depth would match a "$" topic, which MQTT reserves
+func isSystemTopic(topicLevels []string, depth int) bool {
+	return depth == 0 && strings.HasPrefix(topicLevels[0], "$")
+}
+
+// topicNode is one level of the trie used to match published topics against subscription filters
+type topicNode struct {
+	children      map[string]*topicNode
+	subscriptions map[*subscriber]struct{}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:      make(map[string]*topicNode),
+		subscriptions: make(map[*subscriber]struct{}),
+	}
+}
+
+func filterLevels(filter string) []string {
+	if filter == allTopics {
+		return []string{multiLevelWild}
+	}
+
+	return strings.Split(filter, topicSeparator)
+}
+
+// add registers the subscription on the node for the filter
+func (n *topicNode) add(filter string, sub *subscriber) {
+	node := n
+	for _, level := range filterLevels(filter) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	node.subscriptions[sub] = struct{}{}
+}
+
+// remove deregisters the subscription from the node for the filter and prunes empty branches
+func (n *topicNode) remove(filter string, sub *subscriber) {
+	n.removeLevels(filterLevels(filter), sub)
+}
+
+func (n *topicNode) removeLevels(levels []string, sub *subscriber) {
+	if len(levels) == 0 {
+		delete(n.subscriptions, sub)
+		return
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return
+	}
+
+	child.removeLevels(levels[1:], sub)
+
+	if len(child.children) == 0 && len(child.subscriptions) == 0 {
+		delete(n.children, levels[0])
+	}
+}
+
+// match collects every subscription with a filter matching the topic
+func (n *topicNode) match(topic string, matched map[*subscriber]struct{}) {
+	n.matchLevels(strings.Split(topic, topicSeparator), 0, matched)
+}
+
+func (n *topicNode) matchLevels(levels []string, depth int, matched map[*subscriber]struct{}) {
+	wildcardsAllowed := !isSystemTopic(levels, 0) || depth > 0
+
+	if child, ok := n.children[multiLevelWild]; ok && wildcardsAllowed {
+		for sub := range child.subscriptions {
+			matched[sub] = struct{}{}
+		}
+	}
+
+	if depth == len(levels) {
+		for sub := range n.subscriptions {
+			matched[sub] = struct{}{}
+		}
+		return
+	}
+
+	if child, ok := n.children[levels[depth]]; ok {
+		child.matchLevels(levels, depth+1, matched)
+	}
+
+	if child, ok := n.children[singleLevelWild]; ok && wildcardsAllowed {
+		child.matchLevels(levels, depth+1, matched)
+	}
+}
@@ -0,0 +1,148 @@
+package channel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"sensors/floor2/temp", "sensors/floor2/temp", true},
+		{"sensors/floor2/temp", "sensors/floor3/temp", false},
+		{"sensors/+/temp", "sensors/floor2/temp", true},
+		{"sensors/+/temp", "sensors/floor2/humidity", false},
+		{"sensors/+/temp", "sensors/floor2/room1/temp", false},
+		{"sensors/#", "sensors/floor2/temp", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "actuators/floor2", false},
+		{"#", "sensors/floor2/temp", true},
+		{"*", "c1", true},
+		{"+", "$SYS", false},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+
+	for _, c := range cases {
+		if got := MatchTopic(c.filter, c.topic); got != c.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", c.filter, c.topic, got, c.want)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	cases := []struct {
+		filter string
+		valid  bool
+	}{
+		{"sensors/floor2/temp", true},
+		{"sensors/+/temp", true},
+		{"sensors/#", true},
+		{"*", true},
+		{"", false},
+		{"sensors/#/temp", false},
+		{"sensors/floor+/temp", false},
+		{"sensors#", false},
+	}
+
+	for _, c := range cases {
+		if err := ValidateTopicFilter(c.filter); (err == nil) != c.valid {
+			t.Errorf("ValidateTopicFilter(%q) = %v, want valid = %v", c.filter, err, c.valid)
+		}
+	}
+}
+
+func TestRegisterMessageChannelRejectsInvalidTopicFilter(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message)
+
+	if err := ch.RegisterMessageChannel(&c, []string{"sensors/#/temp"}); err == nil {
+		t.Errorf("RegisterMessageChannel(c, []string{\"sensors/#/temp\"}) = nil, want error")
+	}
+}
+
+func TestSendMessageSendsToWildcardSubscribers(t *testing.T) {
+	var ch Hub
+
+	single := make(chan Message, 1)
+	ch.RegisterMessageChannel(&single, []string{"sensors/+/temp"})
+
+	multi := make(chan Message, 1)
+	ch.RegisterMessageChannel(&multi, []string{"sensors/#"})
+
+	other := make(chan Message, 1)
+	ch.RegisterMessageChannel(&other, []string{"sensors/+/humidity"})
+
+	ch.SendMessage("21.5", "sensors/floor2/temp")
+
+	for name, c := range map[string]chan Message{"sensors/+/temp": single, "sensors/#": multi} {
+		select {
+		case received := <-c:
+			if received.Topic != "sensors/floor2/temp" {
+				t.Errorf("%v; Received topic = %v, want sensors/floor2/temp", name, received.Topic)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v; received nothing, want sensors/floor2/temp", name)
+		}
+	}
+
+	select {
+	case received := <-other:
+		t.Errorf("sensors/+/humidity; Received = %v, want nothing", received)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestOverlappingFiltersDeliverOnce(t *testing.T) {
+	var ch Hub
+
+	c := make(chan Message, 2)
+	ch.RegisterMessageChannel(&c, []string{"sensors/#", "sensors/+/temp", "*"})
+
+	ch.SendMessage("21.5", "sensors/floor2/temp")
+	time.Sleep(10 * time.Millisecond)
+
+	if len(c) != 1 {
+		t.Errorf("SendMessage() to overlapping filters; Received %v messages, want 1", len(c))
+	}
+}
+
+func BenchmarkSendMessageManySubscriptions(b *testing.B) {
+	var ch Hub
+
+	for i := 0; i < 10000; i++ {
+		c := make(chan Message)
+		ch.RegisterMessageChannel(&c, []string{fmt.Sprintf("sensors/floor%d/room%d/temp", i%100, i/100)})
+	}
+
+	message := NewTextMessage("sensors/floor2/temp", "21.5")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch.Publish(message)
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	cases := []struct {
+		topic string
+		valid bool
+	}{
+		{"sensors/floor2/temp", true},
+		{"*", true},
+		{"", false},
+		{"sensors/+/temp", false},
+		{"sensors/#", false},
+	}
+
+	for _, c := range cases {
+		if err := ValidateTopic(c.topic); (err == nil) != c.valid {
+			t.Errorf("ValidateTopic(%q) = %v, want valid = %v", c.topic, err, c.valid)
+		}
+	}
+}
@@ -0,0 +1,513 @@
+// Package wal implements a segmented, append-only write-ahead log that can back a channel.Hub
+// so published messages survive restarts.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+const (
+	segmentExt = ".wal"
+
+	// headerSize is the length and CRC32 written before every record
+	headerSize = 8
+	// maxRecordSize bounds a single record so a torn length can not cause a huge allocation
+	maxRecordSize = 64 * 1024 * 1024
+
+	// DefaultSegmentSize is the size a segment grows to before the log rotates to a new one
+	DefaultSegmentSize = 16 * 1024 * 1024
+	// DefaultSyncInterval is how often the log is synced to disk with the SyncInterval policy
+	DefaultSyncInterval = time.Second
+	// DefaultRetentionInterval is how often MaxAge is applied while the log is open
+	DefaultRetentionInterval = time.Minute
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt marks a record that was torn by a crash or does not match its checksum
+var errCorrupt = errors.New("corrupt record")
+
+// SyncPolicy decides when appended records are flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the log after every append
+	SyncAlways SyncPolicy = iota
+	// SyncInterval syncs the log in the background every Options.SyncInterval
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+// ParseSyncPolicy converts "always", "interval" or "never" into a SyncPolicy
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+
+	return SyncAlways, fmt.Errorf("unknown sync policy %q", s)
+}
+
+// Options is used to specify configuration for the Log
+type Options struct {
+	// SegmentSize is the size in bytes a segment grows to before the log rotates, defaults to DefaultSegmentSize
+	SegmentSize int64
+	// Sync decides when appends are flushed to disk
+	Sync SyncPolicy
+	// SyncInterval is how often the log is synced with the SyncInterval policy, defaults to DefaultSyncInterval
+	SyncInterval time.Duration
+	// MaxAge removes segments last written longer ago than MaxAge, zero keeps segments forever.
+	// The active segment is rotated once its first record is older than MaxAge, so a quiet log
+	// keeps a message for between MaxAge and twice MaxAge.
+	MaxAge time.Duration
+	// RetentionInterval is how often MaxAge is applied, defaults to DefaultRetentionInterval
+	RetentionInterval time.Duration
+	// MaxBytes removes the oldest segments once the log is larger than MaxBytes, zero is unlimited
+	MaxBytes int64
+}
+
+// Log is a segmented append-only log of channel messages, it implements channel.Store
+type Log struct {
+	sync.Mutex
+	dir      string
+	options  Options
+	segments []int
+	active   segmentFile
+	size     int64
+	closed   bool
+	stop     chan struct{}
+	loops    sync.WaitGroup
+
+	// since is when the active segment's first record was written
+	since time.Time
+	// failed is set when a failed append could not be removed or the active segment was lost,
+	// the log takes no more appends
+	failed error
+}
+
+// segmentFile is the active segment, tests replace it to fail writes
+type segmentFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// Open opens the log in dir, creating the directory if needed. A record torn by a crash at
+// the end of the newest segment is truncated away so appends continue from the last good record.
+func Open(dir string, options Options) (*Log, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DefaultSegmentSize
+	}
+
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = DefaultSyncInterval
+	}
+
+	if options.RetentionInterval <= 0 {
+		options.RetentionInterval = DefaultRetentionInterval
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{dir: dir, options: options, segments: segments, stop: make(chan struct{})}
+
+	if len(segments) == 0 {
+		l.segments = []int{0}
+	} else if err := l.recover(); err != nil {
+		return nil, err
+	}
+
+	if err := l.openActive(); err != nil {
+		return nil, err
+	}
+
+	if err := l.enforceRetention(); err != nil {
+		l.active.Close()
+		return nil, err
+	}
+
+	if options.Sync == SyncInterval {
+		l.loops.Add(1)
+		go l.syncLoop()
+	}
+
+	if options.MaxAge > 0 {
+		l.loops.Add(1)
+		go l.retentionLoop()
+	}
+
+	return l, nil
+}
+
+// Append writes the message to the active segment, rotating to a new segment when it is full
+func (l *Log) Append(message channel.Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("message of %v bytes is larger than the %v byte record limit", len(data), maxRecordSize)
+	}
+
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(data, crcTable))
+	copy(record[headerSize:], data)
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return errors.New("log is closed")
+	}
+
+	if l.failed != nil {
+		return l.failed
+	}
+
+	if l.size > 0 && l.size+int64(len(record)) > l.options.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if l.size == 0 {
+		l.since = time.Now()
+	}
+
+	n, err := l.active.Write(record)
+	if err == nil && l.options.Sync == SyncAlways {
+		err = l.active.Sync()
+	}
+
+	if err != nil {
+		// Remove what was written of the record. A torn record would lose the records appended
+		// after it when recovery truncates there, and a whole one would share its sequence with
+		// the next message, as the Hub does not count a failed append.
+		if n > 0 {
+			if truncErr := l.active.Truncate(l.size); truncErr != nil {
+				l.failed = fmt.Errorf("log has a record that failed to append: %v", truncErr)
+			}
+		}
+
+		return err
+	}
+
+	l.size += int64(n)
+
+	return nil
+}
+
+// Replay calls fn with every message in the log, oldest first
+func (l *Log) Replay(fn func(channel.Message) error) error {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, segment := range l.segments {
+		f, err := os.Open(l.segmentPath(segment))
+		if err != nil {
+			return err
+		}
+
+		_, err = readRecords(f, fn)
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("replaying segment %v: %v", segment, err)
+		}
+	}
+
+	return nil
+}
+
+// Close syncs and closes the active segment
+func (l *Log) Close() error {
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.Unlock()
+
+	close(l.stop)
+	l.loops.Wait()
+
+	l.Lock()
+	defer l.Unlock()
+
+	if err := l.active.Sync(); err != nil {
+		l.active.Close()
+		return err
+	}
+
+	return l.active.Close()
+}
+
+// recover truncates the newest segment after its last intact record
+func (l *Log) recover() error {
+	path := l.segmentPath(l.segments[len(l.segments)-1])
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	good, err := readRecords(f, func(channel.Message) error { return nil })
+	if err == nil {
+		return nil
+	}
+
+	if err != errCorrupt {
+		return err
+	}
+
+	if err := f.Truncate(good); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (l *Log) openActive() error {
+	f, err := os.OpenFile(l.segmentPath(l.segments[len(l.segments)-1]), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.active = f
+	l.size = info.Size()
+	l.since = info.ModTime()
+
+	return nil
+}
+
+// rotate closes the active segment and starts a new one, the lock must be held. The log fails
+// if the closed segment can not be replaced.
+func (l *Log) rotate() error {
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+
+	if err := l.active.Close(); err != nil {
+		l.failed = fmt.Errorf("log failed to close segment: %v", err)
+		return l.failed
+	}
+
+	l.segments = append(l.segments, l.segments[len(l.segments)-1]+1)
+
+	if err := l.openActive(); err != nil {
+		l.failed = fmt.Errorf("log failed to open segment: %v", err)
+		return l.failed
+	}
+
+	return l.enforceRetention()
+}
+
+// enforceRetention removes the oldest segments past MaxAge or MaxBytes.
+// The active segment is never removed. The lock must be held.
+func (l *Log) enforceRetention() error {
+	if l.options.MaxAge <= 0 && l.options.MaxBytes <= 0 {
+		return nil
+	}
+
+	infos := make([]os.FileInfo, len(l.segments))
+	total := int64(0)
+
+	for i, segment := range l.segments {
+		info, err := os.Stat(l.segmentPath(segment))
+		if err != nil {
+			return err
+		}
+
+		infos[i] = info
+		total += info.Size()
+	}
+
+	removed := 0
+	for i := 0; i < len(l.segments)-1; i++ {
+		expired := l.options.MaxAge > 0 && time.Since(infos[i].ModTime()) > l.options.MaxAge
+		oversized := l.options.MaxBytes > 0 && total > l.options.MaxBytes
+
+		if !expired && !oversized {
+			break
+		}
+
+		if err := os.Remove(l.segmentPath(l.segments[i])); err != nil {
+			return err
+		}
+
+		total -= infos[i].Size()
+		removed++
+	}
+
+	l.segments = l.segments[removed:]
+
+	return nil
+}
+
+func (l *Log) syncLoop() {
+	defer l.loops.Done()
+
+	ticker := time.NewTicker(l.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.Lock()
+			l.active.Sync()
+			l.Unlock()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// retentionLoop applies MaxAge until the log is closed. Once the active segment's first record
+// has expired the segment is rotated, so a log too quiet to fill its segments is trimmed too.
+func (l *Log) retentionLoop() {
+	defer l.loops.Done()
+
+	ticker := time.NewTicker(l.options.RetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.Lock()
+			if l.failed == nil {
+				var err error
+				if l.size > 0 && time.Since(l.since) > l.options.MaxAge {
+					err = l.rotate()
+				} else {
+					err = l.enforceRetention()
+				}
+
+				// Nothing else would report the error, so appends fail with it
+				if err != nil && l.failed == nil {
+					l.failed = fmt.Errorf("log failed to apply retention: %v", err)
+				}
+			}
+			l.Unlock()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *Log) segmentPath(segment int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%v", segment, segmentExt))
+}
+
+// listSegments returns the segment numbers found in dir in order
+func listSegments(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]int, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentExt) {
+			continue
+		}
+
+		segment, err := strconv.Atoi(strings.TrimSuffix(file.Name(), segmentExt))
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, segment)
+	}
+
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// readRecords calls fn with every record in r and returns the offset after the last intact record.
+// It returns errCorrupt if the records end in a torn or mismatched record.
+func readRecords(r io.Reader, fn func(channel.Message) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, headerSize)
+	offset := int64(0)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return offset, errCorrupt
+			}
+			return offset, err
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxRecordSize {
+			return offset, errCorrupt
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, errCorrupt
+			}
+			return offset, err
+		}
+
+		if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, errCorrupt
+		}
+
+		var message channel.Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			return offset, errCorrupt
+		}
+
+		if err := fn(message); err != nil {
+			return offset, err
+		}
+
+		offset += int64(headerSize + len(data))
+	}
+}
@@ -0,0 +1,277 @@
+package wal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func replayAll(t *testing.T, l *Log) []channel.Message {
+	messages := make([]channel.Message, 0)
+
+	err := l.Replay(func(m channel.Message) error {
+		messages = append(messages, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay() = %v, want nil", err)
+	}
+
+	return messages
+}
+
+func TestAppendIsReplayedAfterReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{})
+	for i, m := range []string{"one", "two", "three"} {
+		message := channel.NewTextMessage("c1", m)
+		message.Sequence = uint64(i + 1)
+		l.Append(message)
+	}
+	l.Close()
+
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open() = %v, want nil", err)
+	}
+	defer l.Close()
+
+	messages := replayAll(t, l)
+
+	if len(messages) != 3 || messages[0].String() != "one" || messages[2].Sequence != 3 {
+		t.Errorf("Replay() = %v, want [one two three]", messages)
+	}
+}
+
+func TestAppendRotatesSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{SegmentSize: 200, Sync: SyncNever})
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		l.Append(channel.NewTextMessage("c1", "howdy doody"))
+	}
+
+	if segments, _ := listSegments(dir); len(segments) < 2 {
+		t.Errorf("listSegments() = %v, want the log to rotate", segments)
+	}
+
+	if messages := replayAll(t, l); len(messages) != 10 {
+		t.Errorf("Replay() returned %v messages, want 10", len(messages))
+	}
+}
+
+func TestOpenTruncatesTornRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{})
+	l.Append(channel.NewTextMessage("c1", "one"))
+	l.Append(channel.NewTextMessage("c1", "two"))
+	l.Close()
+
+	// Simulate a crash half way through writing a record
+	path := filepath.Join(dir, "00000000000000000000.wal")
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-3)
+
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open() = %v, want nil", err)
+	}
+	defer l.Close()
+
+	l.Append(channel.NewTextMessage("c1", "three"))
+
+	messages := replayAll(t, l)
+
+	if len(messages) != 2 || messages[0].String() != "one" || messages[1].String() != "three" {
+		t.Errorf("Replay() = %v, want [one three]", messages)
+	}
+}
+
+// tornFile writes half of every record before failing, as a full disk would
+type tornFile struct {
+	segmentFile
+}
+
+func (f tornFile) Write(p []byte) (int, error) {
+	n, _ := f.segmentFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestFailedAppendLeavesNoTornRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{})
+	l.Append(channel.NewTextMessage("c1", "one"))
+
+	active := l.active
+	l.active = tornFile{active}
+	if err := l.Append(channel.NewTextMessage("c1", "two")); err == nil {
+		t.Errorf("Append(two) to a full disk = nil, want error")
+	}
+	l.active = active
+
+	l.Append(channel.NewTextMessage("c1", "three"))
+	l.Close()
+
+	l, _ = Open(dir, Options{})
+	defer l.Close()
+
+	messages := replayAll(t, l)
+
+	if len(messages) != 2 || messages[0].String() != "one" || messages[1].String() != "three" {
+		t.Errorf("Replay() = %v, want [one three]", messages)
+	}
+}
+
+// unsyncedFile fails every sync, as a disk that lost its writes would
+type unsyncedFile struct {
+	segmentFile
+}
+
+func (f unsyncedFile) Sync() error {
+	return errors.New("input/output error")
+}
+
+func TestFailedSyncRemovesRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{Sync: SyncAlways})
+	l.Append(channel.NewTextMessage("c1", "one"))
+
+	active := l.active
+	l.active = unsyncedFile{active}
+	if err := l.Append(channel.NewTextMessage("c1", "two")); err == nil {
+		t.Errorf("Append(two) with a failed sync = nil, want error")
+	}
+	l.active = active
+
+	l.Append(channel.NewTextMessage("c1", "three"))
+	l.Close()
+
+	l, _ = Open(dir, Options{})
+	defer l.Close()
+
+	messages := replayAll(t, l)
+
+	if len(messages) != 2 || messages[0].String() != "one" || messages[1].String() != "three" {
+		t.Errorf("Replay() = %v, want [one three]", messages)
+	}
+}
+
+func TestFailedRotationStopsAppends(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{MaxAge: 20 * time.Millisecond, RetentionInterval: 5 * time.Millisecond})
+	defer l.Close()
+
+	l.Append(channel.NewTextMessage("c1", "one"))
+
+	// Without its directory the log can not open a new segment
+	os.RemoveAll(dir)
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		err = l.Append(channel.NewTextMessage("c1", "two"))
+	}
+
+	if err == nil {
+		t.Errorf("Append() after a failed rotation = nil, want error")
+	}
+}
+
+func TestMaxAgeTrimsQuietLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{MaxAge: 20 * time.Millisecond, RetentionInterval: 5 * time.Millisecond})
+	defer l.Close()
+
+	l.Append(channel.NewTextMessage("c1", "one"))
+
+	for i := 0; i < 100 && len(replayAll(t, l)) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if messages := replayAll(t, l); len(messages) != 0 {
+		t.Errorf("Replay() after MaxAge = %v, want the message removed", messages)
+	}
+
+	l.Append(channel.NewTextMessage("c1", "two"))
+
+	if messages := replayAll(t, l); len(messages) != 1 || messages[0].String() != "two" {
+		t.Errorf("Replay() = %v, want [two]", messages)
+	}
+}
+
+func TestMaxBytesRemovesOldestSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{SegmentSize: 200, MaxBytes: 400, Sync: SyncNever})
+	defer l.Close()
+
+	for i := 0; i < 20; i++ {
+		l.Append(channel.NewTextMessage("c1", "howdy doody"))
+	}
+
+	segments, _ := listSegments(dir)
+	if len(segments) > 3 || segments[0] == 0 {
+		t.Errorf("listSegments() = %v, want the oldest segments removed", segments)
+	}
+}
+
+func TestHubRestoresFromLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, Options{})
+	hub := channel.Hub{HistorySize: 10, Store: l}
+	hub.SendMessage("one", "c1")
+	hub.Publish(channel.Message{Topic: "c2", Payload: []byte("two"), Retain: true})
+	l.Close()
+
+	l, _ = Open(dir, Options{})
+	defer l.Close()
+
+	hub = channel.Hub{HistorySize: 10, Store: l}
+	if err := hub.Restore(); err != nil {
+		t.Fatalf("Restore() = %v, want nil", err)
+	}
+
+	if history := hub.History([]string{"#"}, channel.Earliest()); len(history) != 2 {
+		t.Errorf("History() after Restore() = %v, want [one two]", history)
+	}
+
+	if retained := hub.Retained("c2"); len(retained) != 1 {
+		t.Errorf("Retained(\"c2\") after Restore() = %v, want [two]", retained)
+	}
+
+	if next, _ := hub.Publish(channel.NewTextMessage("c1", "three")); next.Sequence != 3 {
+		t.Errorf("Publish() after Restore(); Sequence = %v, want 3", next.Sequence)
+	}
+}
@@ -1,50 +1,125 @@
 package clients
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/benjamingram/stem/channel"
+	"github.com/benjamingram/stem/module"
 )
 
 // Console represents the client that sends output to the console
 type Console struct {
-	Hub     *channel.Hub
-	channel chan string
+	Hub          *channel.Hub
+	subscription *channel.Subscription
+	printed      chan struct{}
+}
+
+// Name labels the Console in the launcher
+func (cc *Console) Name() string {
+	return "Console"
 }
 
 // Start begins listening for new messages on the Hub
-func (cc *Console) Start() {
-	c := make(chan string)
-	cc.channel = c
+func (cc *Console) Start(ctx context.Context) error {
+	if cc.subscription != nil {
+		return nil
+	}
 
-	cc.Hub.RegisterChannel(&cc.channel, []string{"*"})
+	// The subscription outlives ctx, which only bounds starting
+	s, err := cc.Hub.SubscribeWith(context.Background(), []string{"#"}, channel.Name("console"))
+	if err != nil {
+		return fmt.Errorf("console failed to subscribe: %v", err)
+	}
+
+	cc.subscription = s
+
+	printed := make(chan struct{})
+	cc.printed = printed
 
 	go func() {
-		for {
-			message, more := <-cc.channel
-
-			if more {
-				fmt.Println(message)
-			} else {
-				cc.channel = nil
-				return
-			}
+		defer close(printed)
+
+		for message := range s.C {
+			fmt.Println(formatMessage(message))
 		}
 	}()
 
 	log.Println("Console Client Started")
+
+	return nil
 }
 
-// Stop ends listening for new messages on the Hub
-func (cc *Console) Stop() {
-	// If the channel is already closed, nothing more to do
-	if cc.channel == nil {
-		return
+// Stop ends listening for new messages once the messages already queued are printed,
+// or ctx ends
+func (cc *Console) Stop(ctx context.Context) error {
+	// If the subscription has already ended, nothing more to do
+	if cc.subscription == nil {
+		return nil
 	}
 
-	cc.Hub.DeregisterChannel(&cc.channel)
-	close(cc.channel)
+	// The closed subscription still hands over the messages it had queued
+	cc.subscription.Unsubscribe()
+	cc.subscription = nil
+
+	select {
+	case <-cc.printed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	log.Println("Console Client Stopped")
+
+	return nil
+}
+
+// Status reports whether the Console is printing messages
+func (cc *Console) Status() module.Status {
+	return module.Status{Running: cc.subscription != nil}
+}
+
+// formatMessage renders the payload for a terminal according to its content type
+func formatMessage(message channel.Message) string {
+	switch channel.KindOf(message.ContentType) {
+	case channel.JSONContent:
+		var b bytes.Buffer
+		if json.Compact(&b, message.Payload) == nil {
+			return b.String()
+		}
+	case channel.FormContent:
+		if values, err := url.ParseQuery(message.String()); err == nil {
+			return formatValues(values)
+		}
+	case channel.BinaryContent:
+		if payload, encoding := message.EncodedPayload(); encoding != "" {
+			return fmt.Sprintf("[%v bytes of %v] %v", len(message.Payload), message.ContentType, payload)
+		}
+	}
+
+	return message.String()
+}
+
+// formatValues renders form values as key=value pairs sorted by key
+func formatValues(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range values[key] {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+
+	return strings.Join(pairs, " ")
 }
@@ -0,0 +1,283 @@
+// Package sse streams Hub messages to HTTP clients as Server-Sent Events.
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+const (
+	// TopicParam selects a topic filter to stream, it may be repeated
+	TopicParam = "topic"
+	// AfterParam resumes the stream after a sequence number for clients that can not set LastEventIDHeader
+	AfterParam = "after"
+	// LastEventIDHeader is sent by a reconnecting EventSource with the id of the last event it received
+	LastEventIDHeader = "Last-Event-ID"
+	// DefaultTopic is streamed when the request does not select a topic
+	DefaultTopic = "#"
+
+	// DefaultHeartbeatInterval is how often an idle stream is sent a comment to keep it open
+	DefaultHeartbeatInterval = 15 * time.Second
+
+	// retryInterval is how long a disconnected EventSource waits before reconnecting
+	retryInterval = 3 * time.Second
+)
+
+// Stream keeps a registry of connected event streams, each with its own Hub subscription
+type Stream struct {
+	sync.Mutex
+	clients      map[*client]struct{}
+	shuttingDown bool
+
+	Hub *channel.Hub
+
+	// HeartbeatInterval is how often an idle stream is sent a comment so proxies do not
+	// close it, defaults to DefaultHeartbeatInterval
+	HeartbeatInterval time.Duration
+}
+
+type client struct {
+	cancel   context.CancelFunc
+	draining chan struct{}
+	finished chan struct{}
+}
+
+// event is the JSON data of a message event
+type event struct {
+	Sequence    uint64    `json:"sequence"`
+	ID          string    `json:"id"`
+	Topic       string    `json:"topic"`
+	Timestamp   time.Time `json:"timestamp"`
+	ContentType string    `json:"contentType,omitempty"`
+	Payload     string    `json:"payload"`
+	Encoding    string    `json:"encoding,omitempty"`
+	Retain      bool      `json:"retain,omitempty"`
+}
+
+// HandleStream subscribes the request to the topics in its query string and streams the
+// matching messages until the client goes away. A reconnecting client resumes from the Hub's
+// history after the sequence in its Last-Event-ID header.
+func (s *Stream) HandleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	from, err := requestOffset(r, s.Hub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	c := &client{cancel: cancel, draining: make(chan struct{}), finished: make(chan struct{})}
+	defer close(c.finished)
+
+	if !s.add(c) {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.remove(c)
+
+	sub, err := s.Hub.SubscribeWith(ctx, requestTopics(r),
+		channel.Name("sse "+r.RemoteAddr),
+		channel.From(from),
+		channel.Backpressure(channel.Disconnect))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stops nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", retryInterval/time.Millisecond)
+	flusher.Flush()
+
+	heartbeat := s.HeartbeatInterval
+	if heartbeat <= 0 {
+		heartbeat = DefaultHeartbeatInterval
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-sub.C:
+			// The Hub ends a subscription that falls behind, the client resumes when it reconnects
+			if !ok {
+				return
+			}
+
+			if err := writeEvent(w, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-c.draining:
+			// Ending the subscription leaves its queued messages in C to be written
+			sub.Unsubscribe()
+			for message := range sub.C {
+				if err := writeEvent(w, message); err != nil {
+					return
+				}
+			}
+
+			flusher.Flush()
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// Count returns the number of connected streams
+func (s *Stream) Count() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.clients)
+}
+
+// Shutdown refuses new streams, writes every message already queued for the connected ones and
+// ends them. Streams still being written when ctx ends are closed at once.
+func (s *Stream) Shutdown(ctx context.Context) error {
+	s.Lock()
+	s.shuttingDown = true
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	// Each client is drained once, even if Shutdown is called again
+	s.clients = nil
+	s.Unlock()
+
+	for _, c := range clients {
+		close(c.draining)
+	}
+
+	for i, c := range clients {
+		select {
+		case <-c.finished:
+		case <-ctx.Done():
+			for _, c := range clients[i:] {
+				c.cancel()
+			}
+
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// add registers the client, it reports false once the Stream is shutting down
+func (s *Stream) add(c *client) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+
+	if s.clients == nil {
+		s.clients = make(map[*client]struct{})
+	}
+
+	s.clients[c] = struct{}{}
+
+	return true
+}
+
+func (s *Stream) remove(c *client) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.clients, c)
+}
+
+// writeEvent writes the message as an event whose id is its sequence number
+func writeEvent(w http.ResponseWriter, message channel.Message) error {
+	payload, encoding := message.EncodedPayload()
+
+	data, err := json.Marshal(event{
+		Sequence:    message.Sequence,
+		ID:          message.ID,
+		Topic:       message.Topic,
+		Timestamp:   message.Timestamp,
+		ContentType: message.ContentType,
+		Payload:     payload,
+		Encoding:    encoding,
+		Retain:      message.Retain,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", message.Sequence, data)
+
+	return err
+}
+
+// requestTopics returns the topic filters selected by the query string
+func requestTopics(r *http.Request) []string {
+	topics := []string{}
+
+	for _, topic := range r.URL.Query()[TopicParam] {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+
+	if len(topics) == 0 {
+		return []string{DefaultTopic}
+	}
+
+	return topics
+}
+
+// requestOffset returns where the stream starts, the Last-Event-ID header wins over the after parameter
+func requestOffset(r *http.Request, hub *channel.Hub) (channel.Offset, error) {
+	after := r.Header.Get(LastEventIDHeader)
+	if after == "" {
+		after = r.URL.Query().Get(AfterParam)
+	}
+
+	if after == "" {
+		return channel.Latest(), nil
+	}
+
+	sequence, err := strconv.ParseUint(after, 10, 64)
+	if err != nil {
+		return channel.Latest(), fmt.Errorf("invalid last event id %q", after)
+	}
+
+	return hub.After(sequence), nil
+}
@@ -0,0 +1,244 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+func connect(t *testing.T, server *httptest.Server, query string, lastEventID string) (*http.Response, *bufio.Reader) {
+	req, err := http.NewRequest("GET", server.URL+"/?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lastEventID != "" {
+		req.Header.Set(LastEventIDHeader, lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func waitForStreams(s *Stream, count int) {
+	for i := 0; i < 100 && s.Count() != count; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readEvent returns the lines of the next event, skipping the retry preamble
+func readEvent(t *testing.T, reader *bufio.Reader) []string {
+	lines := []string{}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString() = %v, want event", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line != "" {
+			lines = append(lines, line)
+			continue
+		}
+
+		if len(lines) == 0 || strings.HasPrefix(lines[0], "retry:") {
+			lines = lines[:0]
+			continue
+		}
+
+		return lines
+	}
+}
+
+func readMessage(t *testing.T, reader *bufio.Reader) (string, event) {
+	lines := readEvent(t, reader)
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "id: ") || !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatalf("readEvent() = %q, want id and data", lines)
+	}
+
+	var e event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &e); err != nil {
+		t.Fatalf("json.Unmarshal(%q) = %v", lines[1], err)
+	}
+
+	return strings.TrimPrefix(lines[0], "id: "), e
+}
+
+func TestStreamsSelectedTopics(t *testing.T) {
+	s := Stream{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleStream))
+	defer server.Close()
+
+	resp, reader := connect(t, server, "topic=sensors/%23", "")
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	waitForStreams(&s, 1)
+
+	s.Hub.SendMessage("on", "actuators/fan")
+	s.Hub.SendMessage("21.5", "sensors/temp")
+
+	id, e := readMessage(t, reader)
+	if id != "2" || e.Topic != "sensors/temp" || e.Payload != "21.5" {
+		t.Errorf("readMessage() = %v, %+v, want 2, sensors/temp: 21.5", id, e)
+	}
+}
+
+func TestLastEventIDResumesFromHistory(t *testing.T) {
+	s := Stream{Hub: &channel.Hub{HistorySize: 10}}
+
+	for _, text := range []string{"one", "two", "three"} {
+		s.Hub.SendMessage(text, "sensors/temp")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleStream))
+	defer server.Close()
+
+	resp, reader := connect(t, server, "topic=sensors/temp", "1")
+	defer resp.Body.Close()
+
+	for _, want := range []string{"two", "three"} {
+		if _, e := readMessage(t, reader); e.Payload != want {
+			t.Errorf("readMessage() = %+v, want %v", e, want)
+		}
+	}
+}
+
+func TestLastEventIDAheadOfHubResumesFromEarliest(t *testing.T) {
+	s := Stream{Hub: &channel.Hub{HistorySize: 10}}
+
+	for _, text := range []string{"one", "two", "three"} {
+		s.Hub.SendMessage(text, "sensors/temp")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleStream))
+	defer server.Close()
+
+	// The client saw message 500 before the Hub restarted
+	resp, reader := connect(t, server, "topic=sensors/temp", "500")
+	defer resp.Body.Close()
+
+	for _, want := range []string{"one", "two", "three"} {
+		if _, e := readMessage(t, reader); e.Payload != want {
+			t.Errorf("readMessage() = %+v, want %v", e, want)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	s := Stream{Hub: &channel.Hub{}, HeartbeatInterval: 10 * time.Millisecond}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleStream))
+	defer server.Close()
+
+	resp, reader := connect(t, server, "", "")
+	defer resp.Body.Close()
+
+	if lines := readEvent(t, reader); len(lines) != 1 || lines[0] != ": heartbeat" {
+		t.Errorf("readEvent() = %q, want heartbeat comment", lines)
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	s := Stream{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleStream))
+	defer server.Close()
+
+	for _, test := range []struct {
+		query, lastEventID string
+	}{
+		{"topic=sensors/te%23mp", ""},
+		{"", "latest"},
+		{"after=-1", ""},
+	} {
+		resp, _ := connect(t, server, test.query, test.lastEventID)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET ?%v Last-Event-ID %q; StatusCode = %v, want %v", test.query, test.lastEventID, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestShutdownEndsStreamsWhenContextEnds(t *testing.T) {
+	s := Stream{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleStream))
+	defer server.Close()
+
+	resp, reader := connect(t, server, "", "")
+	defer resp.Body.Close()
+
+	waitForStreams(&s, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+
+	for {
+		if _, err := reader.ReadString('\n'); err != nil {
+			break
+		}
+	}
+
+	if count := s.Count(); count != 0 {
+		t.Errorf("Count() = %v, want 0", count)
+	}
+}
+
+func TestShutdownWritesQueuedEvents(t *testing.T) {
+	s := Stream{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleStream))
+	defer server.Close()
+
+	resp, reader := connect(t, server, "topic=sensors/%23", "")
+	defer resp.Body.Close()
+
+	waitForStreams(&s, 1)
+
+	for _, payload := range []string{"21.5", "22.0"} {
+		s.Hub.SendMessage(payload, "sensors/temp")
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() = %v, want nil", err)
+	}
+
+	for _, payload := range []string{"21.5", "22.0"} {
+		if _, e := readMessage(t, reader); e.Payload != payload {
+			t.Errorf("Shutdown(); Received = %+v, want %v", e, payload)
+		}
+	}
+
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Shutdown(); stream still open, want it ended")
+	}
+
+	refused, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Body.Close()
+
+	if refused.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET after Shutdown(); StatusCode = %v, want %v", refused.StatusCode, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,231 @@
+package clients
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/benjamingram/stem/channel"
+	"github.com/benjamingram/stem/clients/sse"
+	"github.com/benjamingram/stem/listener"
+	"github.com/benjamingram/stem/module"
+)
+
+var (
+	ssePageTemplate = template.Must(template.New("sseHost").Parse(sseHostTemplate))
+)
+
+// SSEHost is a wrapper http server to stream Hub messages as Server-Sent Events
+type SSEHost struct {
+	listener  net.Listener
+	server    *http.Server
+	stream    *sse.Stream
+	waitGroup sync.WaitGroup
+
+	Addr string
+	Hub  *channel.Hub
+
+	// TLS, when set, serves the host over TLS
+	TLS *listener.TLS
+}
+
+// Name labels the SSEHost in the launcher
+func (sh *SSEHost) Name() string {
+	return "SSE"
+}
+
+// Start the SSEHost listening for incoming requests
+func (sh *SSEHost) Start(ctx context.Context) error {
+	if sh.listener != nil {
+		return nil
+	}
+
+	l, err := listener.Listen(sh.Addr, sh.TLS)
+	if err != nil {
+		return err
+	}
+
+	// Every request subscribes to the topics in its query string
+	stream := &sse.Stream{Hub: sh.Hub}
+	sh.stream = stream
+	sh.listener = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleSSEHomepage)
+	mux.HandleFunc("/events", stream.HandleStream)
+
+	server := &http.Server{Handler: mux}
+	sh.server = server
+
+	sh.waitGroup.Add(1)
+	go func() {
+		defer sh.waitGroup.Done()
+
+		server.Serve(l)
+	}()
+
+	log.Println("SSE Host Started -", sh.Addr)
+
+	return nil
+}
+
+// Stop ends every stream once the messages queued for it are written and stops taking new
+// requests. Anything still open when ctx ends is closed at once.
+func (sh *SSEHost) Stop(ctx context.Context) error {
+	if sh.listener == nil {
+		return nil
+	}
+
+	log.Println("Stopping SSE Host...")
+
+	err := sh.stream.Shutdown(ctx)
+	if serverErr := sh.server.Shutdown(ctx); serverErr != nil {
+		sh.server.Close()
+		err = serverErr
+	}
+
+	sh.waitGroup.Wait()
+	sh.listener = nil
+	sh.server = nil
+	log.Println("SSE Host Stopped")
+
+	return err
+}
+
+// Status reports whether the SSEHost is running and where its page is served
+func (sh *SSEHost) Status() module.Status {
+	if sh.listener == nil {
+		return module.Status{}
+	}
+
+	return module.Status{Running: true, Location: listener.URL(sh.Addr, sh.TLS), Browsable: true}
+}
+
+func handleSSEHomepage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "Page not found", 404)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ssePageTemplate.Execute(w, r.Host)
+}
+
+const sseHostTemplate = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta http-equiv="X-UA-Compatible" content="IE=edge">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>stem</title>
+  <link href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.5/css/bootstrap.min.css" rel="stylesheet" integrity="sha256-MfvZlkHCEqatNoGiOXveE8FIwMzZg4W85qfrfIFBfYc= sha512-dTfge/zgoMYpP7QbHy4gWMEGsbsdZeCXz7irItjcC3sPUFtf0kuFbDz/ixG7ArTxmDjLXDmezHubeNikyKGVyQ==" crossorigin="anonymous">
+  <link rel="stylesheet" href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.5/css/bootstrap-theme.min.css" integrity="sha384-aUGj/X2zp5rLCbBxumKTCw2Z50WgIr1vs/PFN4praOTvYXWlVyh2UtNUU0KAUhAX" crossorigin="anonymous">
+  <script src="https://ajax.googleapis.com/ajax/libs/jquery/2.1.3/jquery.min.js"></script>
+  <script type="text/javascript">
+      $(function() {
+          var source;
+          var log = $("#log");
+
+          function appendLog(msg) {
+              var d = log[0]
+              var doScroll = d.scrollTop == d.scrollHeight - d.clientHeight;
+              msg.appendTo(log)
+              if (doScroll) {
+                  d.scrollTop = d.scrollHeight - d.clientHeight;
+              }
+          }
+
+          // Summarises binary payloads, which arrive base64 encoded
+          function formatPayload(message) {
+              if (message.encoding == "base64") {
+                  return "[" + atob(message.payload).length + " bytes of " + message.contentType + "]";
+              }
+              return message.payload;
+          }
+
+          // EventSource reconnects by itself and resumes with the Last-Event-ID header
+          function connect() {
+              if (source) {
+                  source.close();
+              }
+
+              var filters = $("#topic-filters").val().split(",").map($.trim).filter(Boolean);
+              source = new EventSource("/events?" + $.param({topic: filters}, true));
+              source.onmessage = function(evt) {
+                  var message = JSON.parse(evt.data);
+                  appendLog($("<div/>").append($("<span class='topic'/>").text(message.topic)).append($("<span/>").text(formatPayload(message))))
+              }
+              source.onerror = function(evt) {
+                  appendLog($("<div><b>Connection lost, reconnecting...</b></div>"))
+              }
+          }
+
+          $("#topics").submit(function(evt) {
+              evt.preventDefault();
+              connect();
+          });
+
+          if (window["EventSource"]) {
+              connect();
+          } else {
+              appendLog($("<div><b>Your browser does not support Server-Sent Events.</b></div>"))
+          }
+      });
+  </script>
+  <style type="text/css">
+    html, body {
+      height: 100%;
+      background-color: #333;
+      overflow: hidden;
+    }
+
+    header {
+      background-color: #f0ad4e;
+      -webkit-box-shadow: inset 0 -2px 5px rgba(0,0,0,.1);
+      box-shadow: inset 0 -2px 5px rgba(0,0,0,.1);
+      text-shadow: 0 1px 3px rgba(0,0,0,.5);
+      color: white;
+      font-size: 1.3em;
+      padding: 10px;
+      margin-bottom: 20px;
+    }
+    .sub-title { color: #d9d9d9; font-size: .8em; }
+
+    #topics { float: right; }
+    #topics input { color: #333; font-size: .8em; width: 200px; }
+    .topic { color: #f0ad4e; margin-right: 10px; }
+
+    #log {
+        color: white;
+        margin: 0;
+        padding: 0.5em 0.5em 0.5em 0.5em;
+
+        overflow: auto;
+    }
+  </style>
+</head>
+<body>
+    <header>
+        <span>Stem</span>
+        -
+        <span class="sub-title">Event Stream Viewer - http://{{$}}/events</span>
+        <form id="topics">
+            <input id="topic-filters" type="text" value="#" title="Comma separated topic filters">
+        </form>
+    </header>
+
+    <div class="fluid">
+      <div id="log"></div>
+    </div>
+</body>
+</html>
+`
@@ -0,0 +1,428 @@
+package websocket
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+	"github.com/gorilla/websocket"
+)
+
+// Close reasons sent to the client when the server ends a connection
+const (
+	slowConsumerReason = "slow consumer: outbound queue full"
+	pongTimeoutReason  = "pong timeout"
+	shutdownReason     = "server shutting down"
+)
+
+// Connection is a single connected socket and the Hub subscription it has asked for.
+// Every frame is queued for the connection's writer, which also pings the client.
+type Connection struct {
+	ws   *websocket.Conn
+	hub  *channel.Hub
+	name string
+
+	// pongWait is how long the client may go without answering a ping, pings are sent every pingPeriod
+	pongWait   time.Duration
+	pingPeriod time.Duration
+
+	// readOnly refuses publish frames
+	readOnly bool
+	// authorize checks the connection may publish to a topic and returns who is publishing
+	authorize func(topic string) (string, error)
+
+	send    chan frame
+	done    chan struct{}
+	written chan struct{}
+
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+
+	// draining is closed by drain, once set under mu no more pumps are started
+	mu        sync.Mutex
+	draining  chan struct{}
+	drainOnce sync.Once
+	pumps     sync.WaitGroup
+	cancel    context.CancelFunc
+
+	// subscription is only touched by the read loop
+	subscription *channel.Subscription
+}
+
+func newConnection(ws *websocket.Conn, hub *channel.Hub, name string, queueSize int) *Connection {
+	return &Connection{
+		ws:         ws,
+		hub:        hub,
+		name:       name,
+		pongWait:   DefaultPongWait,
+		pingPeriod: (DefaultPongWait * 9) / 10,
+		send:       make(chan frame, queueSize),
+		done:       make(chan struct{}),
+		written:    make(chan struct{}),
+		draining:   make(chan struct{}),
+	}
+}
+
+// serve runs the connection until the socket is closed by either side
+func (c *Connection) serve(ctx context.Context) {
+	// Draining ends the subscription through ctx so the pump can flush what it still holds
+	ctx, c.cancel = context.WithCancel(ctx)
+	defer c.cancel()
+
+	go c.write()
+
+	err := c.read(ctx)
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.close(websocket.CloseGoingAway, pongTimeoutReason)
+	} else {
+		c.close(websocket.CloseNormalClosure, "")
+	}
+
+	<-c.written
+}
+
+// read handles control frames from the socket until it fails or is closed
+func (c *Connection) read(ctx context.Context) error {
+	c.ws.SetReadLimit(readLimit)
+	c.ws.SetReadDeadline(time.Now().Add(c.pongWait))
+	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(c.pongWait)); return nil })
+
+	for {
+		_, p, err := c.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(p, &req); err != nil {
+			c.enqueue(newErrorFrame("", fmt.Errorf("malformed frame: %v", err)))
+			continue
+		}
+
+		if err := c.handle(ctx, req); err != nil {
+			c.enqueue(newErrorFrame(req.Ref, err))
+		}
+	}
+}
+
+// write sends queued frames and periodic pings until the connection is closed,
+// then tells the client why with a close frame
+func (c *Connection) write() {
+	defer close(c.written)
+	defer c.ws.Close()
+
+	ticker := time.NewTicker(c.pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case f := <-c.send:
+			if !c.writeFrame(f) {
+				return
+			}
+		case <-ticker.C:
+			if !c.ping() {
+				return
+			}
+		case <-c.draining:
+			if c.flush(ticker) {
+				c.close(websocket.CloseGoingAway, shutdownReason)
+			}
+			c.writeClose()
+			return
+		case <-c.done:
+			c.writeClose()
+			return
+		}
+	}
+}
+
+// flush ends the subscription and writes every frame its pump still holds. It reports false
+// when the connection was closed before it finished.
+func (c *Connection) flush(ticker *time.Ticker) bool {
+	c.mu.Lock()
+	c.cancel()
+	c.mu.Unlock()
+
+	pumped := make(chan struct{})
+	go func() {
+		c.pumps.Wait()
+		close(pumped)
+	}()
+
+	for {
+		select {
+		case f := <-c.send:
+			if !c.writeFrame(f) {
+				return false
+			}
+		case <-ticker.C:
+			if !c.ping() {
+				return false
+			}
+		case <-pumped:
+			// Replies queued alongside the messages are written too
+			for {
+				select {
+				case f := <-c.send:
+					if !c.writeFrame(f) {
+						return false
+					}
+				default:
+					return true
+				}
+			}
+		case <-c.done:
+			return false
+		}
+	}
+}
+
+// writeFrame writes a frame, closing the connection when the write fails
+func (c *Connection) writeFrame(f frame) bool {
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.ws.WriteJSON(f); err != nil {
+		c.close(websocket.CloseAbnormalClosure, "")
+		return false
+	}
+
+	return true
+}
+
+// ping writes a ping, closing the connection when the write fails
+func (c *Connection) ping() bool {
+	if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+		c.close(websocket.CloseAbnormalClosure, "")
+		return false
+	}
+
+	return true
+}
+
+// writeClose tells the client why the connection is closing
+func (c *Connection) writeClose() {
+	// 1006 is reserved for connections that ended without a close frame, so none is sent
+	if c.closeCode != websocket.CloseAbnormalClosure {
+		msg := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+		c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	}
+}
+
+// drain asks the writer to flush the connection's queued messages and close it as going away
+func (c *Connection) drain() {
+	c.drainOnce.Do(func() { close(c.draining) })
+}
+
+// enqueue queues a reply for the writer. A client too slow to keep its queue from filling
+// is evicted, and enqueue reports false.
+func (c *Connection) enqueue(f frame) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- f:
+		return true
+	default:
+		c.close(websocket.ClosePolicyViolation, slowConsumerReason)
+		return false
+	}
+}
+
+// close ends the connection with the close code and reason, only the first call has any effect
+func (c *Connection) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// handle applies a control frame to the connection's subscription or publishes its message
+func (c *Connection) handle(ctx context.Context, req request) error {
+	switch req.Action {
+	case publishAction:
+		if c.readOnly {
+			return errors.New("publishing is disabled on this host")
+		}
+
+		return c.publish(req)
+	case subscribeAction:
+		return c.subscribe(ctx, req.Ref, req.Topics, req.After)
+	case unsubscribeAction:
+		if c.subscription != nil {
+			c.subscription.RemoveTopics(req.Topics...)
+		}
+
+		c.enqueue(c.subscribedFrame(req.Ref))
+
+		return nil
+	default:
+		return fmt.Errorf("unknown action %q", req.Action)
+	}
+}
+
+// subscribe adds topics to the connection's subscription, creating it on first use, and
+// answers with a subscribed frame. A new subscription resumes from the Hub's history when after
+// is set, and its subscribed frame is queued before any message.
+func (c *Connection) subscribe(ctx context.Context, ref string, topics []string, after uint64) error {
+	if c.hub == nil {
+		return errors.New("no hub to subscribe to")
+	}
+
+	if c.subscription != nil {
+		if err := c.subscription.AddTopics(topics...); err != nil {
+			return err
+		}
+
+		c.enqueue(c.subscribedFrame(ref))
+
+		return nil
+	}
+
+	from := channel.Latest()
+	if after > 0 {
+		from = c.hub.After(after)
+	}
+
+	// The writer waits for the pumps once it starts draining, so none may start after that
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return errors.New(shutdownReason)
+	}
+
+	s, err := c.hub.SubscribeWith(ctx, topics,
+		channel.Name(c.name),
+		channel.From(from),
+		channel.Backpressure(channel.Disconnect))
+	if err != nil {
+		return err
+	}
+
+	c.subscription = s
+	c.enqueue(c.subscribedFrame(ref))
+
+	c.pumps.Add(1)
+	go c.pump(s)
+
+	return nil
+}
+
+// subscribedFrame reports the connection's topics and the Hub's last sequence
+func (c *Connection) subscribedFrame(ref string) frame {
+	var sequence uint64
+	if c.hub != nil {
+		sequence = c.hub.Sequence()
+	}
+
+	return newSubscribedFrame(ref, c.topics(), sequence)
+}
+
+// publish sends the request's message to the Hub and acknowledges it
+func (c *Connection) publish(req request) error {
+	if c.hub == nil {
+		return errors.New("no hub to publish to")
+	}
+
+	if err := channel.ValidateTopic(req.Topic); err != nil {
+		return err
+	}
+
+	publisher, err := c.authorize(req.Topic)
+	if err != nil {
+		return err
+	}
+
+	payload, err := decodePayload(req)
+	if err != nil {
+		return err
+	}
+
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = channel.DetectContentType(payload)
+	}
+
+	if err := channel.ValidatePayload(contentType, payload); err != nil {
+		return err
+	}
+
+	message, err := c.hub.Publish(channel.Message{
+		ID:          req.ID,
+		Topic:       req.Topic,
+		Headers:     map[string]string{"Source": c.name},
+		Payload:     payload,
+		ContentType: contentType,
+		Retain:      req.Retain,
+		Publisher:   publisher,
+	})
+	if err != nil && err != channel.ErrDuplicate {
+		return fmt.Errorf("failed to publish: %v", err)
+	}
+
+	c.enqueue(newAckFrame(req.Ref, message, err == channel.ErrDuplicate))
+
+	return nil
+}
+
+// decodePayload returns the request's payload, decoding it when it was sent as base64
+func decodePayload(req request) ([]byte, error) {
+	switch req.Encoding {
+	case "":
+		return []byte(req.Payload), nil
+	case channel.Base64Encoding:
+		payload, err := base64.StdEncoding.DecodeString(req.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed base64 payload: %v", err)
+		}
+
+		return payload, nil
+	}
+
+	return nil, fmt.Errorf("unknown encoding %q", req.Encoding)
+}
+
+// pump queues the subscription's messages for the writer until either ends
+func (c *Connection) pump(s *channel.Subscription) {
+	defer c.pumps.Done()
+	defer s.Unsubscribe()
+
+	for message := range s.C {
+		select {
+		case c.send <- newMessageFrame(message):
+		case <-c.done:
+			return
+		}
+	}
+
+	// A draining connection ends its own subscription
+	select {
+	case <-c.draining:
+		return
+	default:
+	}
+
+	// While the connection is open, the Hub only ends the subscription when the writer has
+	// fallen so far behind that the subscription's queue overflowed
+	c.close(websocket.ClosePolicyViolation, slowConsumerReason)
+}
+
+func (c *Connection) topics() []string {
+	if c.subscription == nil {
+		return []string{}
+	}
+
+	return c.subscription.Topics()
+}
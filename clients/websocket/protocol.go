@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+// Actions a client may request in a control frame
+const (
+	subscribeAction   = "subscribe"
+	unsubscribeAction = "unsubscribe"
+	publishAction     = "publish"
+)
+
+// Frame types sent to the client
+const (
+	messageFrame    = "message"
+	subscribedFrame = "subscribed"
+	ackFrame        = "ack"
+	errorFrame      = "error"
+)
+
+// request is a JSON control frame sent by the client, e.g.
+//
+//	{"action": "subscribe", "topics": ["sensors/#"]}
+//	{"action": "subscribe", "topics": ["sensors/#"], "after": 42}
+//	{"action": "publish", "ref": "1", "topic": "sensors/temp", "payload": "21.5"}
+//	{"action": "publish", "ref": "2", "id": "reading-42", "topic": "sensors/temp", "payload": "21.5"}
+//
+// Ref is echoed back on the subscribed, ack or error frame answering the request.
+type request struct {
+	Action string `json:"action"`
+	Ref    string `json:"ref,omitempty"`
+
+	// Set on subscribe and unsubscribe requests
+	Topics []string `json:"topics,omitempty"`
+
+	// After resumes a reconnecting client from the Hub's history after the last sequence it saw.
+	// It only applies to the connection's first subscribe request. An After beyond the Hub's
+	// sequence was seen before a restart that lost history, so the client resumes from the
+	// earliest history instead.
+	After uint64 `json:"after,omitempty"`
+
+	// Set on publish requests. A message published with an ID is only published once within
+	// the Hub's DedupWindow.
+	ID          string `json:"id,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	Payload     string `json:"payload,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Retain      bool   `json:"retain,omitempty"`
+
+	// Encoding is "base64" when Payload holds base64 encoded binary data
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// frame is a JSON frame sent to the client, its Type decides which fields are set
+type frame struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"`
+
+	// Set on subscribed frames
+	Topics []string `json:"topics,omitempty"`
+
+	// Set on error frames
+	Error string `json:"error,omitempty"`
+
+	// Set on message and ack frames, and on subscribed frames where it is the Hub's last sequence
+	Sequence    uint64     `json:"sequence,omitempty"`
+	ID          string     `json:"id,omitempty"`
+	Topic       string     `json:"topic,omitempty"`
+	Timestamp   *time.Time `json:"timestamp,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Payload     string     `json:"payload,omitempty"`
+	Encoding    string     `json:"encoding,omitempty"`
+	Retain      bool       `json:"retain,omitempty"`
+
+	// Set on ack frames answering a publish that repeated the ID of a recent message
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+func newMessageFrame(message channel.Message) frame {
+	payload, encoding := message.EncodedPayload()
+
+	return frame{
+		Type:        messageFrame,
+		Sequence:    message.Sequence,
+		ID:          message.ID,
+		Topic:       message.Topic,
+		Timestamp:   &message.Timestamp,
+		ContentType: message.ContentType,
+		Payload:     payload,
+		Encoding:    encoding,
+		Retain:      message.Retain,
+	}
+}
+
+func newSubscribedFrame(ref string, topics []string, sequence uint64) frame {
+	return frame{Type: subscribedFrame, Ref: ref, Topics: topics, Sequence: sequence}
+}
+
+func newAckFrame(ref string, message channel.Message, duplicate bool) frame {
+	return frame{Type: ackFrame, Ref: ref, Sequence: message.Sequence, ID: message.ID, Duplicate: duplicate}
+}
+
+func newErrorFrame(ref string, err error) frame {
+	return frame{Type: errorFrame, Ref: ref, Error: err.Error()}
+}
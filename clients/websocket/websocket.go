@@ -1,20 +1,25 @@
 package websocket
 
 import (
-	"errors"
+	"context"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/benjamingram/stem/channel"
 	"github.com/gorilla/websocket"
 )
 
 const (
-	pingPeriod   = (pongWait * 9) / 10
-	pongWait     = 60 * time.Second
 	readDeadline = 60 * time.Second
-	readLimit    = 512
+	readLimit    = 64 * 1024
 	writeWait    = 10 * time.Second
+
+	// DefaultQueueSize is the number of frames queued for a connection before it is evicted
+	DefaultQueueSize = 256
+	// DefaultPongWait is how long a connection may go without answering a ping before it is closed
+	DefaultPongWait = 60 * time.Second
 )
 
 var upgrader = websocket.Upgrader{
@@ -22,32 +27,36 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-// WebSocket wraps the implementation socket and provides external functions
+// WebSocket keeps a registry of connected sockets, each with its own Hub subscription
 type WebSocket struct {
-	ws *websocket.Conn
-}
+	sync.Mutex
+	connections  map[*Connection]struct{}
+	shuttingDown bool
 
-func reader(ws *websocket.Conn) {
-	defer ws.Close()
-	ws.SetReadLimit(readLimit)
-	ws.SetReadDeadline(time.Now().Add(pongWait))
-	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	for {
-		_, _, err := ws.ReadMessage()
-		if err != nil {
-			break
-		}
-	}
-}
+	Hub *channel.Hub
 
-func write(ws *websocket.Conn, mt int, payload []byte) error {
-	if ws == nil {
-		return errors.New("no web socket connection: ws")
-	}
-	ws.SetWriteDeadline(time.Now().Add(writeWait))
-	return ws.WriteMessage(mt, payload)
+	// QueueSize is the number of frames queued for a connection before it is evicted as a
+	// slow consumer, defaults to DefaultQueueSize
+	QueueSize int
+
+	// PongWait is how long a connection may go without answering a ping before it is closed,
+	// defaults to DefaultPongWait. Pings are sent every PingPeriod, which defaults to nine tenths
+	// of PongWait.
+	PongWait   time.Duration
+	PingPeriod time.Duration
+
+	// ReadOnly refuses publish frames
+	ReadOnly bool
+
+	// Authorize, when set, decides which topics each connection may publish to. Without it any
+	// client may publish to any topic.
+	Authorize Authorizer
 }
 
+// Authorizer checks the client that opened its socket with r may publish to the topic. It returns
+// who is publishing, which scopes the IDs the Hub deduplicates, or why the publish is refused.
+type Authorizer func(r *http.Request, topic string) (string, error)
+
 // HandleSocket handles new incoming http requests to the socket
 func (s *WebSocket) HandleSocket(w http.ResponseWriter, r *http.Request) {
 	ws, err := upgrader.Upgrade(w, r, nil)
@@ -61,17 +70,101 @@ func (s *WebSocket) HandleSocket(w http.ResponseWriter, r *http.Request) {
 
 	defer ws.Close()
 
-	s.ws = ws
+	// Subscriptions made by the connection end with it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queueSize := s.QueueSize
+	if queueSize < 1 {
+		queueSize = DefaultQueueSize
+	}
+
+	c := newConnection(ws, s.Hub, "websocket "+r.RemoteAddr, queueSize)
+	if s.PongWait > 0 {
+		c.pongWait = s.PongWait
+		c.pingPeriod = (s.PongWait * 9) / 10
+	}
+	if s.PingPeriod > 0 {
+		c.pingPeriod = s.PingPeriod
+	}
+	c.readOnly = s.ReadOnly
+	c.authorize = func(topic string) (string, error) {
+		if s.Authorize != nil {
+			return s.Authorize(r, topic)
+		}
+
+		return channel.AddressPublisher(r.RemoteAddr), nil
+	}
+
+	if !s.add(c) {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownReason)
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		return
+	}
+	defer s.remove(c)
+
+	c.serve(ctx)
+}
+
+// Count returns the number of connected sockets
+func (s *WebSocket) Count() int {
+	s.Lock()
+	defer s.Unlock()
 
-	reader(ws)
+	return len(s.connections)
 }
 
-func (s WebSocket) Write(p []byte) (n int, err error) {
-	err = write(s.ws, websocket.TextMessage, p)
+// Shutdown refuses new sockets, writes every message already queued for the connected ones and
+// closes them as going away. Sockets still flushing when ctx ends are closed at once.
+func (s *WebSocket) Shutdown(ctx context.Context) error {
+	s.Lock()
+	s.shuttingDown = true
+	connections := make([]*Connection, 0, len(s.connections))
+	for c := range s.connections {
+		connections = append(connections, c)
+	}
+	s.Unlock()
 
-	if err != nil {
-		return 0, err
+	for _, c := range connections {
+		c.drain()
 	}
 
-	return len(p), nil
+	for i, c := range connections {
+		select {
+		case <-c.written:
+		case <-ctx.Done():
+			for _, c := range connections[i:] {
+				c.close(websocket.CloseGoingAway, shutdownReason)
+			}
+
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// add registers the connection, it reports false once the WebSocket is shutting down
+func (s *WebSocket) add(c *Connection) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+
+	if s.connections == nil {
+		s.connections = make(map[*Connection]struct{})
+	}
+
+	s.connections[c] = struct{}{}
+
+	return true
+}
+
+func (s *WebSocket) remove(c *Connection) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.connections, c)
 }
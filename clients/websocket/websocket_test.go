@@ -0,0 +1,450 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+	"github.com/gorilla/websocket"
+)
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ws
+}
+
+func waitForConnections(s *WebSocket, count int) {
+	for i := 0; i < 100 && s.Count() != count; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readFrame(t *testing.T, ws *websocket.Conn) frame {
+	var f frame
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := ws.ReadJSON(&f); err != nil {
+		t.Fatalf("ReadJSON() = %v, want frame", err)
+	}
+
+	return f
+}
+
+func subscribe(t *testing.T, ws *websocket.Conn, topics ...string) {
+	ws.WriteJSON(request{Action: subscribeAction, Topics: topics})
+
+	if f := readFrame(t, ws); f.Type != subscribedFrame {
+		t.Fatalf("subscribe %v; Received = %+v, want subscribed frame", topics, f)
+	}
+}
+
+func TestConnectionsReceiveOnlyTheirTopics(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	sensors := dial(t, server)
+	defer sensors.Close()
+	subscribe(t, sensors, "sensors/#")
+
+	actuators := dial(t, server)
+	defer actuators.Close()
+	subscribe(t, actuators, "actuators/#")
+
+	s.Hub.SendMessage("21.5", "sensors/temp")
+	s.Hub.SendMessage("on", "actuators/fan")
+
+	if f := readFrame(t, sensors); f.Type != messageFrame || f.Topic != "sensors/temp" || f.Payload != "21.5" {
+		t.Errorf("sensors/#; Received = %+v, want sensors/temp: 21.5", f)
+	}
+
+	if f := readFrame(t, actuators); f.Type != messageFrame || f.Topic != "actuators/fan" || f.Payload != "on" {
+		t.Errorf("actuators/#; Received = %+v, want actuators/fan: on", f)
+	}
+}
+
+func TestUnsubscribeStopsTopic(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	subscribe(t, ws, "c1", "c2")
+
+	ws.WriteJSON(request{Action: unsubscribeAction, Topics: []string{"c1"}})
+	if f := readFrame(t, ws); f.Type != subscribedFrame || len(f.Topics) != 1 || f.Topics[0] != "c2" {
+		t.Fatalf("unsubscribe c1; Received = %+v, want subscribed to [c2]", f)
+	}
+
+	s.Hub.SendMessage("one", "c1")
+	s.Hub.SendMessage("two", "c2")
+
+	if f := readFrame(t, ws); f.Payload != "two" {
+		t.Errorf("unsubscribe c1; Received = %+v, want two", f)
+	}
+}
+
+func TestInvalidFramesReturnErrors(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	for _, p := range []string{`not json`, `{"action": "dance"}`, `{"action": "subscribe", "topics": ["a/#/b"]}`} {
+		ws.WriteMessage(websocket.TextMessage, []byte(p))
+
+		if f := readFrame(t, ws); f.Type != errorFrame || f.Error == "" {
+			t.Errorf("%v; Received = %+v, want error frame", p, f)
+		}
+	}
+}
+
+func TestClosedConnectionIsRemoved(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	first := dial(t, server)
+	defer first.Close()
+
+	second := dial(t, server)
+	subscribe(t, second, "#")
+
+	waitForConnections(&s, 2)
+	second.Close()
+	waitForConnections(&s, 1)
+
+	if count := s.Count(); count != 1 {
+		t.Errorf("Count() after closing a connection = %v, want 1", count)
+	}
+
+	for i := 0; i < 100 && len(s.Hub.Stats()) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats := s.Hub.Stats(); len(stats) != 0 {
+		t.Errorf("Stats() after closing a connection = %+v, want its subscription removed", stats)
+	}
+}
+
+func TestPublishIsAcknowledged(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	sub, _ := s.Hub.Subscribe(context.Background(), "sensors/#")
+	defer sub.Unsubscribe()
+
+	ws.WriteJSON(request{Action: publishAction, Ref: "1", Topic: "sensors/temp", Payload: "21.5"})
+
+	if f := readFrame(t, ws); f.Type != ackFrame || f.Ref != "1" || f.Sequence != 1 {
+		t.Errorf("publish; Received = %+v, want ack for ref 1 with sequence 1", f)
+	}
+
+	select {
+	case received := <-sub.C:
+		if received.Topic != "sensors/temp" || received.String() != "21.5" {
+			t.Errorf("publish; Hub received = %v: %v, want sensors/temp: 21.5", received.Topic, received)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("publish; Hub received nothing, want 21.5")
+	}
+
+	ws.WriteJSON(request{Action: publishAction, Ref: "2", Topic: "sensors/#", Payload: "21.5"})
+
+	if f := readFrame(t, ws); f.Type != errorFrame || f.Ref != "2" {
+		t.Errorf("publish to wildcard; Received = %+v, want error for ref 2", f)
+	}
+}
+
+func TestPayloadsKeepTheirContentType(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	subscribe(t, ws, "sensors/#")
+
+	ws.WriteJSON(request{Action: publishAction, Ref: "1", Topic: "sensors/temp", Payload: `{"temp": }`, ContentType: channel.JSONContentType})
+
+	if f := readFrame(t, ws); f.Type != errorFrame || f.Ref != "1" {
+		t.Errorf("publish malformed JSON; Received = %+v, want error for ref 1", f)
+	}
+
+	ws.WriteJSON(request{Action: publishAction, Ref: "2", Topic: "sensors/image", Payload: "/wA=", Encoding: channel.Base64Encoding, ContentType: "image/png"})
+
+	for i := 0; i < 2; i++ {
+		f := readFrame(t, ws)
+		if f.Type == ackFrame {
+			continue
+		}
+
+		if f.Type != messageFrame || f.ContentType != "image/png" || f.Payload != "/wA=" || f.Encoding != channel.Base64Encoding {
+			t.Errorf("publish binary; Received = %+v, want base64 image/png message", f)
+		}
+	}
+}
+
+func TestFullQueueEvictsSlowConsumer(t *testing.T) {
+	c := newConnection(nil, nil, "slow", 1)
+
+	if !c.enqueue(newSubscribedFrame("", nil, 0)) {
+		t.Fatalf("enqueue() with room in the queue = false, want true")
+	}
+
+	if c.enqueue(newSubscribedFrame("", nil, 0)) {
+		t.Errorf("enqueue() with a full queue = true, want false")
+	}
+
+	select {
+	case <-c.done:
+	default:
+		t.Fatalf("enqueue() with a full queue did not close the connection")
+	}
+
+	if c.closeCode != websocket.ClosePolicyViolation || c.closeReason != slowConsumerReason {
+		t.Errorf("enqueue() with a full queue; close = %v %q, want %v %q", c.closeCode, c.closeReason, websocket.ClosePolicyViolation, slowConsumerReason)
+	}
+}
+
+func TestSilentPeerIsClosedWithPongTimeout(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}, PongWait: 50 * time.Millisecond, PingPeriod: 10 * time.Millisecond}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	pinged := make(chan struct{}, 1)
+	ws.SetPingHandler(func(string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := ws.ReadMessage()
+
+	select {
+	case <-pinged:
+	default:
+		t.Errorf("ReadMessage() before pong timeout; no ping received, want pings every PingPeriod")
+	}
+
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseGoingAway || ce.Text != pongTimeoutReason {
+		t.Errorf("ReadMessage() without answering pings = %v, want close %v %q", err, websocket.CloseGoingAway, pongTimeoutReason)
+	}
+}
+
+func TestReadOnlyRefusesPublish(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}, ReadOnly: true}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	ws.WriteJSON(request{Action: publishAction, Ref: "1", Topic: "sensors/temp", Payload: "21.5"})
+
+	if f := readFrame(t, ws); f.Type != errorFrame || f.Ref != "1" {
+		t.Errorf("publish to read only host; Received = %+v, want error for ref 1", f)
+	}
+
+	if sequence := s.Hub.Sequence(); sequence != 0 {
+		t.Errorf("publish to read only host; Hub sequence = %v, want 0", sequence)
+	}
+}
+
+func TestAuthorizeScopesPublishes(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}, Authorize: func(r *http.Request, topic string) (string, error) {
+		if r.Header.Get("X-Stem-Key") != "s3cret" || !strings.HasPrefix(topic, "sensors/") {
+			return "", errors.New("not allowed")
+		}
+
+		return "key collector", nil
+	}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	sub, _ := s.Hub.Subscribe(context.Background(), "#")
+	defer sub.Unsubscribe()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"X-Stem-Key": {"s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	ws.WriteJSON(request{Action: publishAction, Ref: "1", Topic: "actuators/fan", Payload: "on"})
+
+	if f := readFrame(t, ws); f.Type != errorFrame || f.Ref != "1" {
+		t.Errorf("publish to refused topic; Received = %+v, want error for ref 1", f)
+	}
+
+	ws.WriteJSON(request{Action: publishAction, Ref: "2", Topic: "sensors/temp", Payload: "21.5"})
+
+	if f := readFrame(t, ws); f.Type != ackFrame || f.Ref != "2" {
+		t.Errorf("publish to allowed topic; Received = %+v, want ack for ref 2", f)
+	}
+
+	if received := <-sub.C; received.Topic != "sensors/temp" || received.Publisher != "key collector" {
+		t.Errorf("publish to allowed topic; Hub received = %v from %q, want sensors/temp from key collector", received.Topic, received.Publisher)
+	}
+
+	anonymous := dial(t, server)
+	defer anonymous.Close()
+
+	anonymous.WriteJSON(request{Action: publishAction, Ref: "3", Topic: "sensors/temp", Payload: "21.5"})
+
+	if f := readFrame(t, anonymous); f.Type != errorFrame || f.Ref != "3" {
+		t.Errorf("publish without key; Received = %+v, want error for ref 3", f)
+	}
+}
+
+func TestSubscribeResumesAfterSequence(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{HistorySize: 10}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	for _, m := range []string{"one", "two", "three"} {
+		s.Hub.SendMessage(m, "c1")
+	}
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	ws.WriteJSON(request{Action: subscribeAction, Topics: []string{"c1"}, After: 1})
+
+	received := make([]string, 0)
+	for len(received) < 2 {
+		if f := readFrame(t, ws); f.Type == messageFrame {
+			received = append(received, f.Payload)
+		}
+	}
+
+	if received[0] != "two" || received[1] != "three" {
+		t.Errorf("subscribe after 1; Received = %v, want [two three]", received)
+	}
+}
+
+func TestSubscribeAfterRestartResumesFromEarliest(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{HistorySize: 10}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	// The client saw sequence 40 before a restart reset the Hub
+	for _, m := range []string{"one", "two"} {
+		s.Hub.SendMessage(m, "c1")
+	}
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	ws.WriteJSON(request{Action: subscribeAction, Topics: []string{"c1"}, After: 40})
+
+	if f := readFrame(t, ws); f.Type != subscribedFrame || f.Sequence != 2 {
+		t.Fatalf("subscribe after 40; Received = %+v, want subscribed frame with sequence 2", f)
+	}
+
+	for _, expected := range []string{"one", "two"} {
+		if f := readFrame(t, ws); f.Type != messageFrame || f.Payload != expected {
+			t.Errorf("subscribe after 40; Received = %+v, want message %v", f, expected)
+		}
+	}
+}
+
+func TestShutdownFlushesQueuedMessages(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	subscribe(t, ws, "sensors/#")
+
+	for _, payload := range []string{"21.5", "22.0", "22.5"} {
+		s.Hub.SendMessage(payload, "sensors/temp")
+	}
+
+	shutdown := make(chan error)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	for _, payload := range []string{"21.5", "22.0", "22.5"} {
+		if f := readFrame(t, ws); f.Type != messageFrame || f.Payload != payload {
+			t.Errorf("Shutdown(); Received = %+v, want message %v", f, payload)
+		}
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Shutdown(); ReadMessage() = %v, want close %v", err, websocket.CloseGoingAway)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() = %v, want nil", err)
+	}
+
+	refused := dial(t, server)
+	defer refused.Close()
+
+	refused.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := refused.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("dial after Shutdown(); ReadMessage() = %v, want close %v", err, websocket.CloseGoingAway)
+	}
+}
+
+func TestShutdownClosesSocketsWhenContextEnds(t *testing.T) {
+	s := WebSocket{Hub: &channel.Hub{}}
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleSocket))
+	defer server.Close()
+
+	// The client never reads, so the server's writes eventually stall
+	ws := dial(t, server)
+	defer ws.Close()
+	subscribe(t, ws, "#")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.Shutdown(ctx); err != nil && err != context.Canceled {
+		t.Errorf("Shutdown(cancelled) = %v, want nil or %v", err, context.Canceled)
+	}
+
+	waitForConnections(&s, 0)
+
+	if count := s.Count(); count != 0 {
+		t.Errorf("Shutdown(cancelled); Count() = %v, want 0", count)
+	}
+}
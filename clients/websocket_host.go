@@ -1,14 +1,17 @@
 package clients
 
 import (
+	"context"
+	"html/template"
 	"log"
 	"net"
 	"net/http"
 	"sync"
-	"text/template"
 
 	"github.com/benjamingram/stem/channel"
 	"github.com/benjamingram/stem/clients/websocket"
+	"github.com/benjamingram/stem/listener"
+	"github.com/benjamingram/stem/module"
 )
 
 var (
@@ -18,67 +21,93 @@ var (
 // WebSocketHost is a wrapper http server to host the websocket client UI
 type WebSocketHost struct {
 	listener  net.Listener
-	logger    *log.Logger
+	server    *http.Server
+	socket    *websocket.WebSocket
 	waitGroup sync.WaitGroup
 
 	Addr string
 	Hub  *channel.Hub
-}
 
-// Start the WebSocketHost listening for incoming requests
-func (wh *WebSocketHost) Start() {
-	c := make(chan string)
+	// TLS, when set, serves the host over TLS
+	TLS *listener.TLS
 
-	var ws websocket.WebSocket
+	// ReadOnly refuses publishes from connected clients
+	ReadOnly bool
 
-	wh.Hub.RegisterChannel(&c, []string{"*"})
+	// Authorize, when set, decides which topics connected clients may publish to
+	Authorize websocket.Authorizer
+}
 
-	wh.logger = log.New(&ws, "", log.LstdFlags)
+// Name labels the WebSocketHost in the launcher
+func (wh *WebSocketHost) Name() string {
+	return "WebSocket"
+}
 
-	l, err := net.Listen("tcp", wh.Addr)
+// Start the WebSocketHost listening for incoming requests
+func (wh *WebSocketHost) Start(ctx context.Context) error {
+	if wh.listener != nil {
+		return nil
+	}
+
+	l, err := listener.Listen(wh.Addr, wh.TLS)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
+	// Every connection subscribes to the topics it asks for
+	ws := &websocket.WebSocket{Hub: wh.Hub, ReadOnly: wh.ReadOnly, Authorize: wh.Authorize}
+	wh.socket = ws
 	wh.listener = l
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handleHomepage)
 	mux.HandleFunc("/ws", ws.HandleSocket)
 
+	server := &http.Server{Handler: mux}
+	wh.server = server
+
+	wh.waitGroup.Add(1)
 	go func() {
-		wh.waitGroup.Add(1)
 		defer wh.waitGroup.Done()
 
-		http.Serve(l, mux)
-	}()
-
-	go func() {
-		for {
-			message, more := <-c
-
-			if more {
-				wh.logger.Println(message)
-			} else {
-				wh.Hub.DeregisterChannel(&c)
-			}
-		}
+		server.Serve(l)
 	}()
 
 	log.Println("Web Socket Host Started -", wh.Addr)
+
+	return nil
 }
 
-// Stop the WebSocketHost from taking new requests
-func (wh *WebSocketHost) Stop() {
+// Stop closes every socket with a going away close frame once the messages queued for it are
+// written and stops taking new requests. Anything still open when ctx ends is closed at once.
+func (wh *WebSocketHost) Stop(ctx context.Context) error {
 	if wh.listener == nil {
-		return
+		return nil
 	}
 
 	log.Println("Stopping Web Socket Host...")
-	wh.listener.Close()
+
+	err := wh.socket.Shutdown(ctx)
+	if serverErr := wh.server.Shutdown(ctx); serverErr != nil {
+		wh.server.Close()
+		err = serverErr
+	}
+
 	wh.waitGroup.Wait()
 	wh.listener = nil
+	wh.server = nil
 	log.Println("Web Socket Host Stopped")
+
+	return err
+}
+
+// Status reports whether the WebSocketHost is running and where its page is served
+func (wh *WebSocketHost) Status() module.Status {
+	if wh.listener == nil {
+		return module.Status{}
+	}
+
+	return module.Status{Running: true, Location: listener.URL(wh.Addr, wh.TLS), Browsable: true}
 }
 
 func handleHomepage(w http.ResponseWriter, r *http.Request) {
@@ -111,6 +140,10 @@ const websocketHostTemplate = `
       $(function() {
           var conn;
           var log = $("#log");
+          var topics = [];
+          var lastSequence = 0;
+          var retryDelay = 1000;
+          var maxRetryDelay = 30000;
 
           function appendLog(msg) {
               var d = log[0]
@@ -121,14 +154,88 @@ const websocketHostTemplate = `
               }
           }
 
-          if (window["WebSocket"]) {
-              conn = new WebSocket("ws://{{$}}/ws");
+          // Pretty prints JSON and summarises binary payloads, which arrive base64 encoded
+          function formatPayload(frame) {
+              if (frame.encoding == "base64") {
+                  return "[" + atob(frame.payload).length + " bytes of " + frame.contentType + "]";
+              }
+              if (/^application\/(.+\+)?json/.test(frame.contentType || "")) {
+                  try {
+                      return JSON.stringify(JSON.parse(frame.payload));
+                  } catch (e) {
+                  }
+              }
+              return frame.payload;
+          }
+
+          function topicFilters() {
+              return $("#topic-filters").val().split(",").map($.trim).filter(Boolean);
+          }
+
+          function subscribe(filters) {
+              if (topics.length > 0) {
+                  conn.send(JSON.stringify({action: "unsubscribe", topics: topics}));
+              }
+              conn.send(JSON.stringify({action: "subscribe", topics: filters}));
+          }
+
+          // Reconnects resume after the last message seen so nothing published while offline is missed
+          function connect() {
+              conn = new WebSocket((location.protocol == "https:" ? "wss://" : "ws://") + "{{$}}/ws");
+              conn.onopen = function(evt) {
+                  retryDelay = 1000;
+                  topics = [];
+                  conn.send(JSON.stringify({action: "subscribe", topics: topicFilters(), after: lastSequence}));
+              }
               conn.onclose = function(evt) {
-                  appendLog($("<div><b>Connection closed.</b></div>"))
+                  appendLog($("<div><b>Connection closed.</b></div>").append(evt.reason ? $("<span/>").text(" " + evt.reason) : ""))
+                  appendLog($("<div/>").text("Reconnecting in " + retryDelay / 1000 + "s..."))
+                  setTimeout(connect, retryDelay);
+                  retryDelay = Math.min(retryDelay * 2, maxRetryDelay);
               }
               conn.onmessage = function(evt) {
-                  appendLog($("<div/>").text(evt.data))
+                  var frame = JSON.parse(evt.data);
+                  switch (frame.type) {
+                  case "message":
+                      // Retained values of newly selected topics are older than what was seen, but not yet shown
+                      if (frame.sequence <= lastSequence && !frame.retain) {
+                          break;
+                      }
+                      lastSequence = Math.max(lastSequence, frame.sequence);
+                      appendLog($("<div/>").append($("<span class='topic'/>").text(frame.topic)).append($("<span/>").text(formatPayload(frame))))
+                      break;
+                  case "subscribed":
+                      topics = frame.topics;
+                      // A Hub behind the last message seen has restarted and numbers its messages from 1 again
+                      if ((frame.sequence || 0) < lastSequence) {
+                          lastSequence = 0;
+                      }
+                      break;
+                  case "error":
+                      appendLog($("<div class='text-danger'/>").text(frame.error))
+                      break;
+                  }
+              }
+          }
+
+          $("#publish").submit(function(evt) {
+              evt.preventDefault();
+              if (conn && conn.readyState == WebSocket.OPEN) {
+                  conn.send(JSON.stringify({action: "publish", topic: $("#publish-topic").val(), payload: $("#publish-payload").val()}));
+                  $("#publish-payload").val("");
+              }
+          });
+
+          $("#topics").submit(function(evt) {
+              evt.preventDefault();
+              var filters = topicFilters();
+              if (conn && conn.readyState == WebSocket.OPEN && filters.length > 0) {
+                  subscribe(filters);
               }
+          });
+
+          if (window["WebSocket"]) {
+              connect();
           } else {
               appendLog($("<div><b>Your browser does not support WebSockets.</b></div>"))
           }
@@ -153,6 +260,11 @@ const websocketHostTemplate = `
     }
     .sub-title { color: #d9d9d9; font-size: .8em; }
 
+    #topics { float: right; }
+    #topics input, #publish input { color: #333; font-size: .8em; width: 200px; }
+    #publish { position: fixed; bottom: 0; left: 0; right: 0; padding: 10px; background-color: #444; }
+    .topic { color: #5cb85c; margin-right: 10px; }
+
     #log {
         color: white;
         margin: 0;
@@ -167,11 +279,20 @@ const websocketHostTemplate = `
         <span>Stem</span>
         -
         <span class="sub-title">WebSocket Viewer</span>
+        <form id="topics">
+            <input id="topic-filters" type="text" value="#" title="Comma separated topic filters">
+        </form>
     </header>
 
     <div class="fluid">
       <div id="log"></div>
     </div>
+
+    <form id="publish">
+        <input id="publish-topic" type="text" placeholder="Topic">
+        <input id="publish-payload" type="text" placeholder="Message">
+        <button class="btn btn-success btn-xs" type="submit">Publish</button>
+    </form>
 </body>
 </html>
 `
@@ -1,35 +1,139 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/benjamingram/stem/channel/wal"
 	"github.com/benjamingram/stem/hosts"
+	"github.com/benjamingram/stem/listener"
 )
 
 // Command Line Parameters
 var webAddr = flag.String("web-addr", ":8877", "http web service address")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for queued messages to be delivered on shutdown")
+
+var historySize = flag.Int("history", 100, "number of recent messages kept per topic for replay")
+var historyTopics = flag.Int("history-topics", 1000, "most topics history is kept for, the topic published to longest ago is forgotten first")
+var dedupWindow = flag.Duration("dedup-window", 5*time.Minute, "how long message ids are remembered so retried publishes are dropped, 0 disables")
+
+var dataDir = flag.String("data-dir", "", "directory of the write-ahead log, history is kept in memory only when empty")
+var fsync = flag.String("fsync", "interval", "write-ahead log sync policy: always, interval or never")
+var segmentSize = flag.Int64("segment-size", wal.DefaultSegmentSize, "write-ahead log segment size in bytes")
+var retentionAge = flag.Duration("retention-age", 7*24*time.Hour, "remove write-ahead log segments older than this, 0 keeps them forever")
+var retentionBytes = flag.Int64("retention-bytes", 0, "remove the oldest write-ahead log segments beyond this size, 0 is unlimited")
 
 var initConsole = flag.Bool("console", false, "start console client")
 
 var initAPI = flag.Bool("api", false, "start http API service")
 var apiAddr = flag.String("api-addr", ":9988", "http api service address")
+var apiKeys = flag.String("api-keys", "", "JSON file of the keys the http api requires, anyone may publish when empty")
+var webhooks = flag.String("webhooks", "", "JSON file of the signed webhooks the http api accepts")
+var keyRate = flag.Float64("key-rate", 0, "messages per second each api key may publish, 0 is unlimited")
+var keyBurst = flag.Int("key-burst", 0, "messages each api key may publish at once, defaults to key-rate")
+var addrRate = flag.Float64("addr-rate", 0, "messages per second each remote address may publish, 0 is unlimited")
+var addrBurst = flag.Int("addr-burst", 0, "messages each remote address may publish at once, defaults to addr-rate")
+var dailyMessages = flag.Int64("daily-messages", 0, "messages each api key and remote address may publish per day, 0 is unlimited")
+var dailyBytes = flag.Int64("daily-bytes", 0, "bytes each api key and remote address may publish per day, 0 is unlimited")
+var monthlyMessages = flag.Int64("monthly-messages", 0, "messages each api key and remote address may publish per month, 0 is unlimited")
+var monthlyBytes = flag.Int64("monthly-bytes", 0, "bytes each api key and remote address may publish per month, 0 is unlimited")
 
 var initWebSocket = flag.Bool("websocket", false, "start http web socket service")
 var webSocketAddr = flag.String("websocket-addr", ":7766", "web socket service address")
+var webSocketReadOnly = flag.Bool("websocket-read-only", false, "refuse publishes from web socket clients, which are not rate limited")
+
+var initSSE = flag.Bool("sse", false, "start http server-sent events service")
+var sseAddr = flag.String("sse-addr", ":6655", "server-sent events service address")
+
+var tlsCert = flag.String("tls-cert", "", "certificate file serving every service over TLS, plaintext when empty")
+var tlsKey = flag.String("tls-key", "", "private key file of tls-cert")
+var tlsMinVersion = flag.String("tls-min-version", "1.2", "oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+var apiClientCA = flag.String("api-client-ca", "", "CA file verifying client certificates presented to the http api")
+var apiRequireClientCert = flag.Bool("api-require-client-cert", false, "reject http api clients without a verified certificate")
 
 func main() {
 	flag.Parse()
 
-	hostStatus := hosts.HostStatus{API: *initAPI,
-		Console:   *initConsole,
-		WebSocket: *initWebSocket}
+	syncPolicy, err := wal.ParseSyncPolicy(*fsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hostStatus := hosts.HostStatus{"API": *initAPI,
+		"Console":   *initConsole,
+		"WebSocket": *initWebSocket,
+		"SSE":       *initSSE}
+
+	quotas := hosts.Limits{DailyMessages: *dailyMessages,
+		DailyBytes:      *dailyBytes,
+		MonthlyMessages: *monthlyMessages,
+		MonthlyBytes:    *monthlyBytes}
+
+	keyLimits := quotas
+	keyLimits.Rate, keyLimits.Burst = *keyRate, *keyBurst
+
+	addrLimits := quotas
+	addrLimits.Rate, addrLimits.Burst = *addrRate, *addrBurst
+
+	var tlsConfig, apiTLS *listener.TLS
+
+	if *tlsCert != "" {
+		minVersion, err := listener.ParseVersion(*tlsMinVersion)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tlsConfig = &listener.TLS{CertFile: *tlsCert, KeyFile: *tlsKey, MinVersion: minVersion}
+
+		api := *tlsConfig
+		api.ClientCAFile, api.RequireClientCert = *apiClientCA, *apiRequireClientCert
+		apiTLS = &api
+	} else if *apiClientCA != "" {
+		log.Fatal("api-client-ca needs tls-cert and tls-key")
+	}
 
 	host := hosts.Host{Addr: *webAddr,
-		APIAddr:       *apiAddr,
-		WebSocketAddr: *webSocketAddr}
+		APIAddr:           *apiAddr,
+		WebSocketAddr:     *webSocketAddr,
+		WebSocketReadOnly: *webSocketReadOnly,
+		SSEAddr:           *sseAddr,
+		TLS:               tlsConfig,
+		APITLS:            apiTLS,
+		WebSocketTLS:      tlsConfig,
+		SSETLS:            tlsConfig,
+		APIKeysFile:       *apiKeys,
+		WebhooksFile:      *webhooks,
+		KeyLimits:         keyLimits,
+		AddressLimits:     addrLimits,
+		HistorySize:       *historySize,
+		HistoryTopics:     *historyTopics,
+		DedupWindow:       *dedupWindow,
+		DataDir:           *dataDir,
+		LogOptions: wal.Options{SegmentSize: *segmentSize,
+			Sync:     syncPolicy,
+			MaxAge:   *retentionAge,
+			MaxBytes: *retentionBytes}}
 
 	host.Initialize(hostStatus)
-	host.Start()
-}
+	go host.Start()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Println("Received", <-signals, "- shutting down, signal again to exit at once")
 
+	// A second signal gets the default behaviour and ends the process
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
 
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	err = host.Shutdown(ctx)
+	cancel()
+
+	if err != nil {
+		log.Fatal("Shutdown incomplete: ", err)
+	}
+}
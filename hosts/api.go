@@ -1,32 +1,97 @@
 package hosts
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/benjamingram/stem/channel"
+	"github.com/benjamingram/stem/listener"
+	"github.com/benjamingram/stem/module"
+)
+
+const (
+	// topicsPath prefixes the request path of messages published to a topic, e.g. POST /topics/sensors/temp
+	topicsPath = "/topics/"
+	// TopicHeader selects the topic of a published message when it is not part of the path
+	TopicHeader = "X-Stem-Topic"
+	// TopicParam selects the topic of a published message when neither the path nor the header set it
+	TopicParam = "topic"
+	// DefaultTopic is used when the request does not select a topic
+	DefaultTopic = "*"
+	// RetainHeader marks a published message as the retained value of its topic
+	RetainHeader = "X-Stem-Retain"
+	// RetainParam marks a published message as retained when the RetainHeader is not set
+	RetainParam = "retain"
+	// BatchHeader marks the request body as a JSON array of messages to publish
+	BatchHeader = "X-Stem-Batch"
+	// BatchParam marks the request body as a batch when the BatchHeader is not set
+	BatchParam = "batch"
+	// IdempotencyKeyHeader sets the ID of a published message so a retried request is only
+	// published once within the Hub's DedupWindow
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// MessageIDHeader sets the ID of a published message when the IdempotencyKeyHeader is not set,
+	// and answers with the ID of the published message
+	MessageIDHeader = "X-Stem-Message-ID"
+	// SequenceHeader answers with the sequence number of the published message
+	SequenceHeader = "X-Stem-Sequence"
+	// ReplayedHeader is set to true when a request repeated the ID of a recently published message
+	// and is answered with that message's result
+	ReplayedHeader = "Idempotent-Replayed"
 )
 
 // API is used to specify configuration for the API Host
 type API struct {
 	listener  net.Listener
+	server    *http.Server
 	waitGroup sync.WaitGroup
 
+	// stopPolls cancels the requests of the running server, answering waiting polls
+	stopPolls context.CancelFunc
+
 	Addr string
 	Hub  *channel.Hub
+
+	// TLS, when set, serves the API over TLS. Clients whose certificate is verified against its
+	// ClientCAFile are authenticated as the key holding the certificate's common name.
+	TLS *listener.TLS
+
+	// PollTimeout is the longest a GET waits for messages, defaults to DefaultPollTimeout
+	PollTimeout time.Duration
+
+	// Keys, when set, requires every request to present one of its keys and limits the
+	// topics each key may publish to
+	Keys *KeyStore
+
+	// Webhooks accepts signed deliveries from third-party senders on /webhooks/<name>
+	Webhooks *Webhooks
+
+	// Limiter, when set, throttles how much each API key and remote address may publish
+	Limiter *Limiter
+}
+
+// Name labels the API in the launcher
+func (api *API) Name() string {
+	return "API"
 }
 
 // Start begins listening for new requests
-func (api *API) Start() {
-	api.Stop()
+func (api *API) Start(ctx context.Context) error {
+	if api.listener != nil {
+		return nil
+	}
 
 	// Setup listener
-	l, err := net.Listen("tcp", api.Addr)
+	l, err := listener.Listen(api.Addr, api.TLS)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	api.listener = l
@@ -34,36 +99,101 @@ func (api *API) Start() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", api.rootHandler)
 
+	// Requests outlive ctx, which only bounds starting, until Stop answers waiting polls
+	requests, cancel := context.WithCancel(context.Background())
+	api.stopPolls = cancel
+
+	server := &http.Server{Handler: mux, BaseContext: func(net.Listener) context.Context { return requests }}
+	api.server = server
+
+	api.waitGroup.Add(1)
 	go func() {
-		api.waitGroup.Add(1)
 		defer api.waitGroup.Done()
 
-		http.Serve(l, mux)
+		server.Serve(l)
 	}()
 
 	log.Println("API Host Started -", api.Addr)
+
+	return nil
 }
 
-// Stop ends listening for new requests
-func (api *API) Stop() {
+// Stop ends listening for new requests, answers waiting polls and waits for the messages being
+// published to reach the Hub. Requests still running when ctx ends are closed at once.
+func (api *API) Stop(ctx context.Context) error {
 	if api.listener == nil {
-		return
+		return nil
 	}
 
 	log.Println("Stopping API Host...")
 
-	api.listener.Close()
+	api.stopPolls()
+
+	err := api.server.Shutdown(ctx)
+	if err != nil {
+		api.server.Close()
+	}
 
 	api.waitGroup.Wait()
 
 	api.listener = nil
+	api.server = nil
 
 	log.Println("API Host Stopped")
+
+	return err
+}
+
+// Status reports whether the API is running and where it listens
+func (api *API) Status() module.Status {
+	if api.listener == nil {
+		return module.Status{}
+	}
+
+	return module.Status{Running: true, Location: listener.URL(api.Addr, api.TLS)}
 }
 
 func (api *API) rootHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, webhooksPath) {
+		api.webhookHandler(w, r)
+		return
+	}
+
+	key, ok := api.authenticate(w, r)
+	if !ok {
+		return
+	}
+
 	if r.Method == "GET" {
-		http.Error(w, "Method not allowed", 405)
+		api.pollHandler(w, r)
+		return
+	}
+
+	topic, err := requestTopic(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	retain, err := requestRetain(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	batch, err := requestBatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if batch {
+		api.batchHandler(w, r, key, topic, retain)
+		return
+	}
+
+	if err := authorize(key, topic); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
@@ -74,7 +204,137 @@ func (api *API) rootHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	api.Hub.SendMessage(string(val), "*")
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = channel.DetectContentType(val)
+	}
+
+	if err := channel.ValidatePayload(contentType, val); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	message := channel.Message{
+		ID:          requestMessageID(r),
+		Topic:       topic,
+		Headers:     map[string]string{"Source": r.RemoteAddr},
+		Payload:     val,
+		ContentType: contentType,
+		Retain:      retain,
+		Publisher:   publisher(key, r.RemoteAddr),
+	}
+
+	// A retry of a message that was already published is answered without spending the limits
+	if original, ok := api.Hub.Duplicate(message); ok {
+		message, err = original, channel.ErrDuplicate
+	} else {
+		if limited := api.Limiter.take(key, r.RemoteAddr, len(val), time.Now()); limited != nil {
+			tooManyRequests(w, limited)
+			return
+		}
+
+		message, err = api.Hub.Publish(message)
+	}
+
+	if err == channel.ErrDuplicate {
+		w.Header().Set(ReplayedHeader, "true")
+	} else if err != nil {
+		log.Println("API failed to publish:", err)
+		http.Error(w, "Failed to publish message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(MessageIDHeader, message.ID)
+	w.Header().Set(SequenceHeader, strconv.FormatUint(message.Sequence, 10))
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// requestTopic selects the topic to publish to from the request
+func requestTopic(r *http.Request) (string, error) {
+	topic := selectTopic(r)
+
+	if err := channel.ValidateTopic(topic); err != nil {
+		return "", err
+	}
+
+	return topic, nil
+}
+
+// requestTopicFilter selects the topic filter to fetch from the request, it may contain wildcards
+func requestTopicFilter(r *http.Request) (string, error) {
+	filter := selectTopic(r)
+
+	if err := channel.ValidateTopicFilter(filter); err != nil {
+		return "", err
+	}
+
+	return filter, nil
+}
+
+// selectTopic reads the topic from the request path, then the TopicHeader, then the TopicParam
+func selectTopic(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, topicsPath):
+		return strings.TrimPrefix(r.URL.Path, topicsPath)
+	case r.Header.Get(TopicHeader) != "":
+		return r.Header.Get(TopicHeader)
+	case r.URL.Query().Get(TopicParam) != "":
+		return r.URL.Query().Get(TopicParam)
+	}
+
+	return DefaultTopic
+}
+
+// publisher names who publishes the request's messages, scoping the IDs the Hub deduplicates.
+// It is the API key when one is used, otherwise the remote address.
+func publisher(key *APIKey, remoteAddr string) string {
+	if key != nil {
+		return channel.KeyPublisher(key.Name)
+	}
+
+	return channel.AddressPublisher(remoteAddr)
+}
+
+// requestMessageID reads the ID chosen for the message from the IdempotencyKeyHeader, then the MessageIDHeader
+func requestMessageID(r *http.Request) string {
+	if id := r.Header.Get(IdempotencyKeyHeader); id != "" {
+		return id
+	}
+
+	return r.Header.Get(MessageIDHeader)
+}
+
+// requestRetain reads the retain flag from the RetainHeader, then the RetainParam
+func requestRetain(r *http.Request) (bool, error) {
+	return requestFlag(r, RetainHeader, RetainParam, "retain")
+}
+
+// requestBatch reports whether the body holds many messages, either because it is newline
+// delimited JSON or because the BatchHeader, then the BatchParam, says so
+func requestBatch(r *http.Request) (bool, error) {
+	if isNDJSON(r) {
+		return true, nil
+	}
+
+	return requestFlag(r, BatchHeader, BatchParam, "batch")
+}
+
+// requestFlag reads a boolean from the header, then the query parameter
+func requestFlag(r *http.Request, header string, param string, name string) (bool, error) {
+	value := r.Header.Get(header)
+	if value == "" {
+		value = r.URL.Query().Get(param)
+	}
+
+	if value == "" {
+		return false, nil
+	}
+
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %v flag %q", name, value)
+	}
+
+	return flag, nil
+}
@@ -0,0 +1,226 @@
+package hosts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+func TestRequestTopic(t *testing.T) {
+	cases := []struct {
+		target string
+		header string
+		want   string
+	}{
+		{"/", "", DefaultTopic},
+		{"/topics/sensors/temp", "", "sensors/temp"},
+		{"/topics/sensors/temp?topic=other", "other", "sensors/temp"},
+		{"/", "sensors/temp", "sensors/temp"},
+		{"/?topic=other", "sensors/temp", "sensors/temp"},
+		{"/?topic=sensors/temp", "", "sensors/temp"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", c.target, nil)
+		if c.header != "" {
+			r.Header.Set(TopicHeader, c.header)
+		}
+
+		if topic, err := requestTopic(r); err != nil || topic != c.want {
+			t.Errorf("requestTopic(%v, %v: %q) = %q, %v, want %q", c.target, TopicHeader, c.header, topic, err, c.want)
+		}
+	}
+}
+
+func TestRootHandlerPublishesToRequestTopic(t *testing.T) {
+	var hub channel.Hub
+
+	c := make(chan channel.Message, 1)
+	hub.RegisterMessageChannel(&c, []string{"sensors/+"})
+
+	api := API{Hub: &hub}
+
+	w := httptest.NewRecorder()
+	api.rootHandler(w, httptest.NewRequest("POST", "/topics/sensors/temp", strings.NewReader("21.5")))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /topics/sensors/temp; Code = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	select {
+	case received := <-c:
+		if received.Topic != "sensors/temp" || received.String() != "21.5" {
+			t.Errorf("POST /topics/sensors/temp; Received = %v: %v, want sensors/temp: 21.5", received.Topic, received)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("POST /topics/sensors/temp; received nothing, want 21.5")
+	}
+}
+
+func TestRootHandlerRejectsWildcardTopic(t *testing.T) {
+	api := API{Hub: &channel.Hub{}}
+
+	w := httptest.NewRecorder()
+	api.rootHandler(w, httptest.NewRequest("POST", "/topics/sensors/%23", strings.NewReader("21.5")))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /topics/sensors/#; Code = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRootHandlerRetainsMessage(t *testing.T) {
+	var hub channel.Hub
+
+	api := API{Hub: &hub}
+
+	w := httptest.NewRecorder()
+	api.rootHandler(w, httptest.NewRequest("POST", "/topics/sensors/temp?retain=true", strings.NewReader("21.5")))
+
+	if retained := hub.Retained("sensors/temp"); len(retained) != 1 || retained[0].String() != "21.5" {
+		t.Errorf("POST /topics/sensors/temp?retain=true; Retained = %v, want [21.5]", retained)
+	}
+
+	w = httptest.NewRecorder()
+	api.rootHandler(w, httptest.NewRequest("POST", "/topics/sensors/temp?retain=maybe", strings.NewReader("21.5")))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /topics/sensors/temp?retain=maybe; Code = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRootHandlerValidatesPayload(t *testing.T) {
+	var hub channel.Hub
+
+	c := make(chan channel.Message, 2)
+	hub.RegisterMessageChannel(&c, []string{"#"})
+
+	api := API{Hub: &hub}
+
+	cases := []struct {
+		contentType string
+		payload     string
+		code        int
+		want        string
+	}{
+		{"application/json", `{"temp": 21.5}`, http.StatusOK, "application/json"},
+		{"application/json", `{"temp": }`, http.StatusBadRequest, ""},
+		{"application/x-www-form-urlencoded", "temp=%zz", http.StatusBadRequest, ""},
+		{"", "\xff\x00", http.StatusOK, channel.BinaryContentType},
+	}
+
+	for _, test := range cases {
+		r := httptest.NewRequest("POST", "/topics/sensors/temp", strings.NewReader(test.payload))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+
+		w := httptest.NewRecorder()
+		api.rootHandler(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("POST %v %q; Code = %v, want %v", test.contentType, test.payload, w.Code, test.code)
+			continue
+		}
+
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		if received := <-c; received.ContentType != test.want {
+			t.Errorf("POST %v %q; ContentType = %q, want %q", test.contentType, test.payload, received.ContentType, test.want)
+		}
+	}
+}
+
+func TestRootHandlerReplaysIdempotentRequests(t *testing.T) {
+	hub := channel.Hub{DedupWindow: time.Minute}
+
+	c := make(chan channel.Message, 2)
+	hub.RegisterMessageChannel(&c, []string{"#"})
+
+	api := API{Hub: &hub}
+
+	publish := func(header string, id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/topics/sensors/temp", strings.NewReader("21.5"))
+		r.Header.Set(header, id)
+
+		w := httptest.NewRecorder()
+		api.rootHandler(w, r)
+
+		return w
+	}
+
+	first := publish(IdempotencyKeyHeader, "reading-1")
+	if first.Code != http.StatusOK || first.Header().Get(MessageIDHeader) != "reading-1" || first.Header().Get(ReplayedHeader) != "" {
+		t.Fatalf("POST Idempotency-Key: reading-1; Code = %v, Headers = %v, want 200 with ID reading-1", first.Code, first.Header())
+	}
+
+	for _, header := range []string{IdempotencyKeyHeader, MessageIDHeader} {
+		again := publish(header, "reading-1")
+		if again.Code != http.StatusOK || again.Header().Get(ReplayedHeader) != "true" || again.Header().Get(SequenceHeader) != first.Header().Get(SequenceHeader) {
+			t.Errorf("POST %v: reading-1 again; Code = %v, Headers = %v, want replay of sequence %v", header, again.Code, again.Header(), first.Header().Get(SequenceHeader))
+		}
+	}
+
+	select {
+	case <-c:
+	case <-time.After(time.Second):
+		t.Fatalf("POST reading-1; received nothing, want 21.5")
+	}
+
+	select {
+	case received := <-c:
+		t.Errorf("POST reading-1 three times; Received second message %v, want 1", received.Sequence)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestIdempotencyKeysAreScopedToKeyAndTopic(t *testing.T) {
+	keys, err := NewKeyStore([]APIKey{
+		{Name: "a", Key: "a-secret", Topics: []string{"#"}},
+		{Name: "b", Key: "b-secret", Topics: []string{"#"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := API{Hub: &channel.Hub{DedupWindow: time.Minute}, Keys: keys, Limiter: &Limiter{Key: Limits{Rate: 0.001, Burst: 2}}}
+
+	publish := func(key string, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader("21.5"))
+		r.Header.Set(KeyHeader, key)
+		r.Header.Set(IdempotencyKeyHeader, "reading-1")
+
+		w := httptest.NewRecorder()
+		api.rootHandler(w, r)
+
+		return w
+	}
+
+	first := publish("a-secret", "/topics/sensors/temp")
+	if first.Code != http.StatusOK {
+		t.Fatalf("POST a sensors/temp; Code = %v, want %v", first.Code, http.StatusOK)
+	}
+
+	tests := []struct {
+		key      string
+		target   string
+		replayed string
+	}{
+		{"b-secret", "/topics/sensors/temp", ""},
+		{"a-secret", "/topics/sensors/humidity", ""},
+		// The key has spent its burst, but a retry is answered without spending more
+		{"a-secret", "/topics/sensors/temp", "true"},
+	}
+
+	for _, test := range tests {
+		w := publish(test.key, test.target)
+		if w.Code != http.StatusOK || w.Header().Get(ReplayedHeader) != test.replayed {
+			t.Errorf("POST %v %v; Code = %v, %v = %q, want 200, %q", test.key, test.target, w.Code, ReplayedHeader, w.Header().Get(ReplayedHeader), test.replayed)
+		}
+	}
+}
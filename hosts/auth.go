@@ -0,0 +1,200 @@
+package hosts
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+// KeyHeader carries an API key for clients that do not send it as a bearer token
+const KeyHeader = "X-Stem-Key"
+
+// APIKey is a key allowed to use the API, it may only publish to topics matching its Topics
+type APIKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key,omitempty"`
+	Topics []string `json:"topics"`
+
+	// ClientCert is the common name of a verified client certificate that authenticates as this
+	// key, for devices connecting to an API serving mutual TLS
+	ClientCert string `json:"clientCert,omitempty"`
+}
+
+// Allows reports whether the key may publish to the topic
+func (k APIKey) Allows(topic string) bool {
+	for _, filter := range k.Topics {
+		if channel.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeyStore holds the keys the API accepts
+type KeyStore struct {
+	// keys is indexed by the SHA-256 of the key so lookups do not compare secrets byte by byte
+	keys map[[sha256.Size]byte]APIKey
+	// certs is indexed by the client certificate's common name
+	certs map[string]APIKey
+}
+
+// NewKeyStore checks the keys and returns a KeyStore holding them
+func NewKeyStore(keys []APIKey) (*KeyStore, error) {
+	ks := &KeyStore{keys: make(map[[sha256.Size]byte]APIKey, len(keys)), certs: make(map[string]APIKey)}
+
+	for _, key := range keys {
+		if key.Name == "" {
+			return nil, errors.New("API key has no name")
+		}
+
+		if key.Key == "" && key.ClientCert == "" {
+			return nil, fmt.Errorf("API key %q has no key or client certificate", key.Name)
+		}
+
+		for _, filter := range key.Topics {
+			if err := channel.ValidateTopicFilter(filter); err != nil {
+				return nil, fmt.Errorf("API key %q: %v", key.Name, err)
+			}
+		}
+
+		if key.ClientCert != "" {
+			if _, ok := ks.certs[key.ClientCert]; ok {
+				return nil, fmt.Errorf("API key %q duplicates the client certificate of another key", key.Name)
+			}
+
+			ks.certs[key.ClientCert] = key
+		}
+
+		if key.Key == "" {
+			continue
+		}
+
+		hash := sha256.Sum256([]byte(key.Key))
+		if _, ok := ks.keys[hash]; ok {
+			return nil, fmt.Errorf("API key %q duplicates another key", key.Name)
+		}
+
+		ks.keys[hash] = key
+	}
+
+	return ks, nil
+}
+
+// LoadKeys reads a JSON file of keys, e.g.
+//
+//	{"keys": [{"name": "collector", "key": "s3cret", "topics": ["sensors/#"]}]}
+func LoadKeys(path string) (*KeyStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Keys []APIKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("reading API keys from %v: %v", path, err)
+	}
+
+	return NewKeyStore(config.Keys)
+}
+
+// Lookup returns the key matching the secret
+func (ks *KeyStore) Lookup(secret string) (APIKey, bool) {
+	key, ok := ks.keys[sha256.Sum256([]byte(secret))]
+
+	return key, ok
+}
+
+// LookupCert returns the key authenticated by a client certificate with the common name
+func (ks *KeyStore) LookupCert(commonName string) (APIKey, bool) {
+	key, ok := ks.certs[commonName]
+
+	return key, ok
+}
+
+// authenticate returns the key presented by the request, or nil when the API has no keys.
+// It answers 401 Unauthorized and reports false when the key is missing or unknown.
+func (api *API) authenticate(w http.ResponseWriter, r *http.Request) (*APIKey, bool) {
+	if api.Keys == nil {
+		return nil, true
+	}
+
+	key, err := api.Keys.authenticate(r)
+	if err != nil {
+		unauthorized(w, err.Error())
+		return nil, false
+	}
+
+	return &key, true
+}
+
+// authenticate returns the key presented by the request. A verified client certificate is
+// tried before the key sent with the request.
+func (ks *KeyStore) authenticate(r *http.Request) (APIKey, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if key, ok := ks.LookupCert(r.TLS.VerifiedChains[0][0].Subject.CommonName); ok {
+			return key, nil
+		}
+	}
+
+	secret := requestKey(r)
+	if secret == "" {
+		return APIKey{}, errors.New("missing API key, send it as a bearer token or in the " + KeyHeader + " header")
+	}
+
+	key, ok := ks.Lookup(secret)
+	if !ok {
+		return APIKey{}, errors.New("invalid API key")
+	}
+
+	return key, nil
+}
+
+// authorizeSocket lets a WebSocket client publish to the topic when the request that opened its
+// socket presented a key allowed to, see websocket.Authorizer
+func (ks *KeyStore) authorizeSocket(r *http.Request, topic string) (string, error) {
+	key, err := ks.authenticate(r)
+	if err != nil {
+		return "", err
+	}
+
+	if err := authorize(&key, topic); err != nil {
+		return "", err
+	}
+
+	return publisher(&key, r.RemoteAddr), nil
+}
+
+// authorize checks the key may publish to the topic, any topic is allowed without a key
+func authorize(key *APIKey, topic string) error {
+	if key == nil || key.Allows(topic) {
+		return nil
+	}
+
+	return fmt.Errorf("API key %q may not publish to topic %q", key.Name, topic)
+}
+
+// requestKey reads the key from a bearer Authorization header, then the KeyHeader
+func requestKey(r *http.Request) string {
+	const bearer = "bearer "
+
+	if auth := r.Header.Get("Authorization"); len(auth) > len(bearer) && strings.EqualFold(auth[:len(bearer)], bearer) {
+		return strings.TrimSpace(auth[len(bearer):])
+	}
+
+	return r.Header.Get(KeyHeader)
+}
+
+func unauthorized(w http.ResponseWriter, reason string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="stem"`)
+	http.Error(w, reason, http.StatusUnauthorized)
+}
@@ -0,0 +1,196 @@
+package hosts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+func testKeys(t *testing.T) *KeyStore {
+	keys, err := NewKeyStore([]APIKey{
+		{Name: "collector", Key: "collector-secret", Topics: []string{"sensors/#"}},
+		{Name: "reader", Key: "reader-secret"},
+		{Name: "device", ClientCert: "device-1", Topics: []string{"sensors/device-1/#"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stem-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	ioutil.WriteFile(path, []byte(`{"keys": [{"name": "collector", "key": "s3cret", "topics": ["sensors/#"]}]}`), 0600)
+
+	keys, err := LoadKeys(path)
+	if err != nil {
+		t.Fatalf("LoadKeys() = %v, want keys", err)
+	}
+
+	if key, ok := keys.Lookup("s3cret"); !ok || key.Name != "collector" || !key.Allows("sensors/temp") || key.Allows("actuators/fan") {
+		t.Errorf("Lookup(s3cret) = %+v, %v, want collector allowed sensors/#", key, ok)
+	}
+
+	if _, ok := keys.Lookup("guess"); ok {
+		t.Errorf("Lookup(guess) = true, want false")
+	}
+}
+
+func TestNewKeyStoreRejectsInvalidKeys(t *testing.T) {
+	cases := [][]APIKey{
+		{{Key: "s3cret"}},
+		{{Name: "collector"}},
+		{{Name: "collector", Key: "s3cret", Topics: []string{"sensors/#/temp"}}},
+		{{Name: "collector", Key: "s3cret"}, {Name: "other", Key: "s3cret"}},
+		{{Name: "device", ClientCert: "device-1"}, {Name: "other", ClientCert: "device-1"}},
+	}
+
+	for _, keys := range cases {
+		if _, err := NewKeyStore(keys); err == nil {
+			t.Errorf("NewKeyStore(%+v) = nil, want error", keys)
+		}
+	}
+}
+
+func TestRootHandlerRequiresKey(t *testing.T) {
+	api := API{Hub: &channel.Hub{}, Keys: testKeys(t)}
+
+	cases := []struct {
+		header, value string
+		target        string
+		code          int
+	}{
+		{"", "", "/topics/sensors/temp", http.StatusUnauthorized},
+		{"Authorization", "Bearer guess", "/topics/sensors/temp", http.StatusUnauthorized},
+		{"Authorization", "Bearer collector-secret", "/topics/sensors/temp", http.StatusOK},
+		{KeyHeader, "collector-secret", "/topics/sensors/temp", http.StatusOK},
+		{KeyHeader, "collector-secret", "/topics/actuators/fan", http.StatusForbidden},
+		{KeyHeader, "reader-secret", "/topics/sensors/temp", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", c.target, strings.NewReader("21.5"))
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+
+		w := httptest.NewRecorder()
+		api.rootHandler(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("POST %v %v: %q; Code = %v, want %v", c.target, c.header, c.value, w.Code, c.code)
+		}
+
+		if c.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("POST %v %v: %q; WWW-Authenticate not set", c.target, c.header, c.value)
+		}
+	}
+}
+
+func TestBatchItemsAreAuthorized(t *testing.T) {
+	api := API{Hub: &channel.Hub{}, Keys: testKeys(t)}
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("{\"topic\": \"sensors/temp\", \"payload\": 1}\n{\"topic\": \"actuators/fan\", \"payload\": 2}"))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	r.Header.Set(KeyHeader, "collector-secret")
+
+	w := httptest.NewRecorder()
+	api.rootHandler(w, r)
+
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, `"published":1,"failed":1`) {
+		t.Errorf("POST batch; Code = %v, Body = %v, want 1 published, 1 failed", w.Code, body)
+	}
+}
+
+func TestPollRequiresKey(t *testing.T) {
+	api := API{Hub: &channel.Hub{}, Keys: testKeys(t)}
+
+	if w := poll(&api, "/topics/sensors/temp?timeout=0s"); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET without key; Code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	r := httptest.NewRequest("GET", "/topics/sensors/temp?timeout=0s", nil)
+	r.Header.Set("Authorization", "Bearer reader-secret")
+
+	w := httptest.NewRecorder()
+	api.rootHandler(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("GET with key; Code = %v, want %v", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestRootHandlerAuthenticatesClientCertificate(t *testing.T) {
+	api := API{Hub: &channel.Hub{}, Keys: testKeys(t)}
+
+	cases := []struct {
+		commonName string
+		key        string
+		target     string
+		code       int
+	}{
+		{"device-1", "", "/topics/sensors/device-1/temp", http.StatusOK},
+		{"device-1", "", "/topics/sensors/device-2/temp", http.StatusForbidden},
+		{"device-2", "", "/topics/sensors/device-1/temp", http.StatusUnauthorized},
+		{"device-2", "collector-secret", "/topics/sensors/device-2/temp", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", c.target, strings.NewReader("21.5"))
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: c.commonName}}}}}
+		if c.key != "" {
+			r.Header.Set(KeyHeader, c.key)
+		}
+
+		w := httptest.NewRecorder()
+		api.rootHandler(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("POST %v with certificate %v, key %q; Code = %v, want %v", c.target, c.commonName, c.key, w.Code, c.code)
+		}
+	}
+}
+
+func TestAuthorizeSocketChecksKeyTopics(t *testing.T) {
+	keys := testKeys(t)
+
+	cases := []struct {
+		key       string
+		topic     string
+		publisher string
+	}{
+		{"", "sensors/temp", ""},
+		{"wrong-secret", "sensors/temp", ""},
+		{"reader-secret", "sensors/temp", ""},
+		{"collector-secret", "actuators/fan", ""},
+		{"collector-secret", "sensors/temp", "key collector"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		if c.key != "" {
+			r.Header.Set("Authorization", "Bearer "+c.key)
+		}
+
+		publisher, err := keys.authorizeSocket(r, c.topic)
+		if publisher != c.publisher || (err == nil) != (c.publisher != "") {
+			t.Errorf("authorizeSocket(%q, %v) = %q, %v, want %q", c.key, c.topic, publisher, err, c.publisher)
+		}
+	}
+}
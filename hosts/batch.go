@@ -0,0 +1,241 @@
+package hosts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+// ndjsonContentTypes are the content types of newline delimited JSON bodies
+var ndjsonContentTypes = map[string]bool{
+	"application/x-ndjson": true,
+	"application/ndjson":   true,
+	"application/jsonl":    true,
+}
+
+// batchItem is one message of a batch, e.g.
+//
+//	{"topic": "sensors/temp", "payload": 21.5, "retain": true}
+//
+// The topic and retain flag default to those of the request. A string payload is published as
+// text and any other JSON value as JSON, unless the item sets its content type. An item with an
+// id is only published once within the Hub's DedupWindow.
+type batchItem struct {
+	ID          string          `json:"id,omitempty"`
+	Topic       string          `json:"topic,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Retain      *bool           `json:"retain,omitempty"`
+}
+
+// batchResult reports what became of the item at Index
+type batchResult struct {
+	Index    int    `json:"index"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// Duplicate is set when the item repeated the id of a recently published message,
+	// whose Sequence and ID are returned
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// batchSummary is the response to a batch
+type batchSummary struct {
+	Published int           `json:"published"`
+	Failed    int           `json:"failed"`
+	Results   []batchResult `json:"results"`
+}
+
+// batchHandler publishes every item of a JSON array or newline delimited JSON body as its own
+// message. Items are published as they are read, so a chunked upload streams into the Hub.
+// An item that can not be published is reported in the summary without failing the others,
+// but a batch that was throttled before publishing anything is answered with 429 Too Many Requests.
+func (api *API) batchHandler(w http.ResponseWriter, r *http.Request, key *APIKey, topic string, retain bool) {
+	summary := batchSummary{Results: make([]batchResult, 0)}
+
+	var throttled *limitError
+
+	publish := func(index int, item batchItem, err error) {
+		result := batchResult{Index: index}
+
+		if err == nil {
+			var message channel.Message
+			message, err = api.publishItem(r, key, item, topic, retain)
+			if err == channel.ErrDuplicate {
+				result.Duplicate = true
+				err = nil
+			}
+
+			if err == nil {
+				result.Sequence = message.Sequence
+				result.ID = message.ID
+			}
+		}
+
+		if limited, ok := err.(*limitError); ok {
+			throttled = limited
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+			summary.Failed++
+		} else {
+			summary.Published++
+		}
+
+		summary.Results = append(summary.Results, result)
+	}
+
+	var err error
+	if isNDJSON(r) {
+		err = readNDJSON(r.Body, publish)
+	} else {
+		err = readJSONArray(r.Body, publish)
+	}
+
+	if err != nil && summary.Published+summary.Failed == 0 {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", channel.JSONContentType)
+
+	if throttled != nil {
+		setRetryAfter(w, throttled)
+
+		if summary.Published == 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}
+
+	json.NewEncoder(w).Encode(summary)
+}
+
+// publishItem publishes a batch item, filling in the request's topic and retain flag
+func (api *API) publishItem(r *http.Request, key *APIKey, item batchItem, topic string, retain bool) (channel.Message, error) {
+	if item.Topic != "" {
+		topic = item.Topic
+	}
+
+	if err := channel.ValidateTopic(topic); err != nil {
+		return channel.Message{}, err
+	}
+
+	if err := authorize(key, topic); err != nil {
+		return channel.Message{}, err
+	}
+
+	if item.Retain != nil {
+		retain = *item.Retain
+	}
+
+	payload := []byte(item.Payload)
+	contentType := channel.JSONContentType
+
+	var text string
+	if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+		payload = nil
+	} else if json.Unmarshal(payload, &text) == nil {
+		payload = []byte(text)
+		contentType = channel.TextContentType
+	}
+
+	if item.ContentType != "" {
+		contentType = item.ContentType
+	}
+
+	if err := channel.ValidatePayload(contentType, payload); err != nil {
+		return channel.Message{}, err
+	}
+
+	message := channel.Message{
+		ID:          item.ID,
+		Topic:       topic,
+		Headers:     map[string]string{"Source": r.RemoteAddr},
+		Payload:     payload,
+		ContentType: contentType,
+		Retain:      retain,
+		Publisher:   publisher(key, r.RemoteAddr),
+	}
+
+	if original, ok := api.Hub.Duplicate(message); ok {
+		return original, channel.ErrDuplicate
+	}
+
+	if limited := api.Limiter.take(key, r.RemoteAddr, len(payload), time.Now()); limited != nil {
+		return channel.Message{}, limited
+	}
+
+	message, err := api.Hub.Publish(message)
+	if err != nil && err != channel.ErrDuplicate {
+		return message, fmt.Errorf("failed to publish: %v", err)
+	}
+
+	return message, err
+}
+
+// readJSONArray calls fn with every item of a JSON array. Items of the wrong shape are passed
+// on with their error, but malformed JSON ends the array as nothing after it can be trusted.
+func readJSONArray(r io.Reader, fn func(int, batchItem, error)) error {
+	decoder := json.NewDecoder(r)
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return errors.New("batch must be a JSON array")
+	}
+
+	for index := 0; decoder.More(); index++ {
+		var item batchItem
+
+		err := decoder.Decode(&item)
+		if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+			fn(index, item, err)
+			return err
+		}
+
+		fn(index, item, err)
+	}
+
+	_, err := decoder.Token()
+
+	return err
+}
+
+// readNDJSON calls fn with the item on every non-empty line
+func readNDJSON(r io.Reader, fn func(int, batchItem, error)) error {
+	reader := bufio.NewReader(r)
+
+	for index := 0; ; {
+		line, readErr := reader.ReadBytes('\n')
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var item batchItem
+			err := json.Unmarshal(line, &item)
+			fn(index, item, err)
+			index++
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// isNDJSON reports whether the request body is newline delimited JSON
+func isNDJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return err == nil && ndjsonContentTypes[mediaType]
+}
@@ -0,0 +1,150 @@
+package hosts
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+func publishBatch(t *testing.T, api *API, target string, contentType string, body string) batchSummary {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+
+	w := httptest.NewRecorder()
+	api.rootHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST %v %v; Code = %v, want %v", target, body, w.Code, http.StatusOK)
+	}
+
+	var summary batchSummary
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatalf("POST %v %v; Decode() = %v, want summary", target, body, err)
+	}
+
+	return summary
+}
+
+func TestBatchPublishesJSONArray(t *testing.T) {
+	hub := channel.Hub{HistorySize: 10}
+	api := API{Hub: &hub}
+
+	summary := publishBatch(t, &api, "/topics/sensors/temp?batch=true", channel.JSONContentType,
+		`[{"payload": 21.5}, {"payload": "warm"}, {"topic": "sensors/humidity", "payload": {"value": 40}, "retain": true}]`)
+
+	if summary.Published != 3 || summary.Failed != 0 || len(summary.Results) != 3 || summary.Results[2].Sequence != 3 {
+		t.Fatalf("POST batch; Summary = %+v, want 3 published", summary)
+	}
+
+	history := hub.History([]string{"#"}, channel.Earliest())
+	cases := []struct {
+		topic, payload, contentType string
+	}{
+		{"sensors/temp", "21.5", channel.JSONContentType},
+		{"sensors/temp", "warm", channel.TextContentType},
+		{"sensors/humidity", `{"value": 40}`, channel.JSONContentType},
+	}
+
+	for i, c := range cases {
+		if m := history[i]; m.Topic != c.topic || m.String() != c.payload || m.ContentType != c.contentType {
+			t.Errorf("POST batch; History[%v] = %v: %v (%v), want %v: %v (%v)", i, m.Topic, m, m.ContentType, c.topic, c.payload, c.contentType)
+		}
+	}
+
+	if retained := hub.Retained("sensors/humidity"); len(retained) != 1 {
+		t.Errorf("POST batch; Retained(sensors/humidity) = %v, want 1 message", retained)
+	}
+}
+
+func TestBatchReportsFailedItems(t *testing.T) {
+	api := API{Hub: &channel.Hub{}}
+
+	summary := publishBatch(t, &api, "/topics/sensors/temp", "application/x-ndjson",
+		"{\"payload\": 1}\n\n{\"topic\": \"sensors/#\", \"payload\": 2}\nnot json\n{\"payload\": 3}")
+
+	if summary.Published != 2 || summary.Failed != 2 {
+		t.Fatalf("POST ndjson; Summary = %+v, want 2 published, 2 failed", summary)
+	}
+
+	for i, failed := range []bool{false, true, true, false} {
+		if result := summary.Results[i]; result.Index != i || (result.Error != "") != failed {
+			t.Errorf("POST ndjson; Results[%v] = %+v, want failed %v", i, result, failed)
+		}
+	}
+}
+
+func TestBatchReportsDuplicateItems(t *testing.T) {
+	api := API{Hub: &channel.Hub{DedupWindow: time.Minute}}
+
+	summary := publishBatch(t, &api, "/topics/sensors/temp", "application/x-ndjson",
+		"{\"id\": \"reading-1\", \"payload\": 1}\n{\"id\": \"reading-1\", \"payload\": 1}")
+
+	if summary.Published != 2 || summary.Results[0].Duplicate || !summary.Results[1].Duplicate || summary.Results[1].Sequence != summary.Results[0].Sequence {
+		t.Errorf("POST ndjson with repeated id; Summary = %+v, want second item a duplicate of the first", summary)
+	}
+}
+
+func TestBatchRejectsNonArray(t *testing.T) {
+	api := API{Hub: &channel.Hub{}}
+
+	r := httptest.NewRequest("POST", "/topics/sensors/temp", strings.NewReader(`{"payload": 1}`))
+	r.Header.Set(BatchHeader, "true")
+
+	w := httptest.NewRecorder()
+	api.rootHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST batch object; Code = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBatchStreamsChunkedUpload(t *testing.T) {
+	hub := channel.Hub{}
+	api := API{Hub: &hub}
+
+	server := httptest.NewServer(http.HandlerFunc(api.rootHandler))
+	defer server.Close()
+
+	c := make(chan channel.Message, 1)
+	hub.RegisterMessageChannel(&c, []string{"sensors/temp"})
+
+	body, upload := io.Pipe()
+	done := make(chan *http.Response)
+
+	go func() {
+		resp, err := http.Post(server.URL+"/topics/sensors/temp", "application/x-ndjson", body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		done <- resp
+	}()
+
+	// The first reading is published before the upload finishes
+	io.WriteString(upload, "{\"payload\": 1}\n")
+	if m := <-c; m.String() != "1" {
+		t.Errorf("chunked upload; Received = %v, want 1", m)
+	}
+
+	io.WriteString(upload, "{\"payload\": 2}\n")
+	upload.Close()
+
+	resp := <-done
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var summary batchSummary
+	json.NewDecoder(resp.Body).Decode(&summary)
+
+	if summary.Published != 2 {
+		t.Errorf("chunked upload; Summary = %+v, want 2 published", summary)
+	}
+}
@@ -1,98 +1,288 @@
 package hosts
 
 import (
-  "log"
-  "net"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
-	"text/template"
+	"time"
 
 	"github.com/benjamingram/stem/channel"
+	"github.com/benjamingram/stem/channel/wal"
 	"github.com/benjamingram/stem/clients"
+	"github.com/benjamingram/stem/listener"
+	"github.com/benjamingram/stem/module"
 	"github.com/gorilla/mux"
 )
 
-// HostStatus is used to track hosts that should be running
-type HostStatus struct {
-	API       bool
-	Console   bool
-	WebSocket bool
-}
+// changeTimeout bounds how long a module started or stopped from the launcher may take
+const changeTimeout = 10 * time.Second
+
+// HostStatus names the modules that should be running when the Host is initialized,
+// e.g. HostStatus{"API": true, "Console": true}
+type HostStatus map[string]bool
 
 // Host provides configuration for Host and ClientHosts
 type Host struct {
+	sync.Mutex
 	initialized bool
-	console     clients.Console
-	webSocket   clients.WebSocketHost
-	api         API
+	modules     []module.Module
+	api         *API
+
+	// sources counts the modules at the front of modules, which are stopped before the sinks
+	sources int
 
-	hub        *channel.Hub
-	hostStatus HostStatus
-	listener   net.Listener
-	waitGroup  sync.WaitGroup
+	hub       *channel.Hub
+	listener  net.Listener
+	server    *http.Server
+	waitGroup sync.WaitGroup
 
 	Addr          string
 	APIAddr       string
 	WebSocketAddr string
+	SSEAddr       string
+	HistorySize   int
+	HistoryTopics int
+
+	// TLS, APITLS, WebSocketTLS and SSETLS, when set, serve the launcher and each host over TLS
+	TLS          *listener.TLS
+	APITLS       *listener.TLS
+	WebSocketTLS *listener.TLS
+	SSETLS       *listener.TLS
+
+	// DedupWindow is how long published message IDs are remembered to drop retried publishes
+	DedupWindow time.Duration
+
+	// APIKeysFile, when set, is a JSON file of the keys the API requires, see LoadKeys
+	APIKeysFile string
+	// WebhooksFile, when set, is a JSON file of the webhooks the API accepts, see LoadWebhooks
+	WebhooksFile string
+
+	// WebSocketReadOnly refuses publishes from WebSocket clients. When APIKeysFile is set they
+	// may otherwise publish only with a key allowed to, but are not held to the limits.
+	WebSocketReadOnly bool
+
+	// KeyLimits and AddressLimits throttle how much each API key and remote address may publish
+	KeyLimits     Limits
+	AddressLimits Limits
+
+	// DataDir, when set, keeps a write-ahead log of published messages so history survives restarts
+	DataDir    string
+	LogOptions wal.Options
+}
+
+// modulePanel is a module's panel on the control panel
+type modulePanel struct {
+	module.Status
+	Name string
+	Path string
 }
 
 var homepageTemplate = template.Must(template.New("launcherTemplate").Parse(launcherTemplate))
 
-// Initialize initializes the host with initialStatus
+// Initialize registers the API, WebSocket, SSE and Console modules alongside any registered
+// before it, and starts those named by initialStatus
 func (h *Host) Initialize(initialStatus HostStatus) {
-	var ch channel.Hub
+	ch := h.Hub()
 
 	// Initialize hosts
-	h.console = clients.Console{Hub: &ch}
-	h.webSocket = clients.WebSocketHost{Addr: h.WebSocketAddr, Hub: &ch}
-	h.api = API{Addr: h.APIAddr, Hub: &ch}
+	h.api = &API{Addr: h.APIAddr, Hub: ch, TLS: h.APITLS}
+	socketHost := &clients.WebSocketHost{Addr: h.WebSocketAddr, Hub: ch, TLS: h.WebSocketTLS, ReadOnly: h.WebSocketReadOnly}
 
-	// Initialize hosts' states
-	h.syncHostStatuses(initialStatus)
+	if h.APIKeysFile != "" {
+		keys, err := LoadKeys(h.APIKeysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		h.api.Keys = keys
+		socketHost.Authorize = keys.authorizeSocket
+	}
 
-	handler := h.mapRoutes()
-	http.Handle("/", handler)
+	if h.WebhooksFile != "" {
+		webhooks, err := LoadWebhooks(h.WebhooksFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		h.api.Webhooks = webhooks
+	}
+
+	if !h.KeyLimits.IsZero() || !h.AddressLimits.IsZero() {
+		h.api.Limiter = &Limiter{Key: h.KeyLimits, Address: h.AddressLimits}
+	}
+
+	if err := h.RegisterSource(h.api); err != nil {
+		log.Fatal(err)
+	}
+
+	// WebSocket clients publish too, but the host is stopped with the sinks as it delivers what
+	// the other sources publish
+	for _, m := range []module.Module{
+		socketHost,
+		&clients.SSEHost{Addr: h.SSEAddr, Hub: ch, TLS: h.SSETLS},
+		&clients.Console{Hub: ch},
+	} {
+		if err := h.Register(m); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Sinks start first so they receive everything the sources publish
+	for i := len(h.modules) - 1; i >= 0; i-- {
+		if m := h.modules[i]; initialStatus[m.Name()] {
+			if err := m.Start(context.Background()); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	h.server = &http.Server{Handler: h.mapRoutes()}
 
 	h.initialized = true
 	log.Println("Web Host Initialized")
 }
 
-// Start initiates listening for new requests
-func (h *Host) Start() {
-	log.Println("Web Host Started -", h.Addr)
-	http.ListenAndServe(h.Addr, nil)
+// Hub returns the Hub the modules publish to and subscribe on. It is created on first use, so
+// modules can be given it and registered before Initialize.
+func (h *Host) Hub() *channel.Hub {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.hub == nil {
+		h.hub = h.newHub()
+	}
+
+	return h.hub
 }
 
-func (h *Host) syncHostStatuses(hs HostStatus) {
-	if h.hostStatus.API != hs.API {
-		if hs.API {
-			h.api.Start()
-		} else {
-			h.api.Stop()
+// newHub creates the Hub, restoring its history from the write-ahead log when DataDir is set
+func (h *Host) newHub() *channel.Hub {
+	ch := &channel.Hub{HistorySize: h.HistorySize, HistoryTopics: h.HistoryTopics, DedupWindow: h.DedupWindow}
+
+	if h.DataDir != "" {
+		l, err := wal.Open(h.DataDir, h.LogOptions)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		h.hostStatus.API = hs.API
+		ch.Store = l
+
+		if err := ch.Restore(); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	if h.hostStatus.Console != hs.Console {
-		if hs.Console {
-			h.console.Start()
-		} else {
-			h.console.Stop()
+	return ch
+}
+
+// Register adds a sink of messages to the control panel, which can then start and stop it at
+// /<name>/start and /<name>/stop. Sinks are stopped after every source, in the order they
+// were registered.
+func (h *Host) Register(m module.Module) error {
+	return h.register(m, false)
+}
+
+// RegisterSource adds a module that publishes to the Hub, like Register. Sources are stopped
+// before every sink, so the messages they published are delivered.
+func (h *Host) RegisterSource(m module.Module) error {
+	return h.register(m, true)
+}
+
+func (h *Host) register(m module.Module, source bool) error {
+	path := modulePath(m)
+	if path == "" || strings.ContainsAny(path, "/?#") {
+		return fmt.Errorf("invalid module name %q", m.Name())
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.module(path); ok {
+		return fmt.Errorf("module %q is already registered", m.Name())
+	}
+
+	if !source {
+		h.modules = append(h.modules, m)
+		return nil
+	}
+
+	h.modules = append(h.modules[:h.sources], append([]module.Module{m}, h.modules[h.sources:]...)...)
+	h.sources++
+
+	return nil
+}
+
+// Start initiates listening for new requests, it returns once Shutdown is called
+func (h *Host) Start() {
+	l, err := listener.Listen(h.Addr, h.TLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	h.listener = l
+
+	log.Println("Web Host Started -", h.Addr)
+	if err := h.server.Serve(l); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// Shutdown stops the launcher taking requests, then stops every source and then every sink in
+// the order they were registered. The Hub delivers what each module published before the next is stopped, and the
+// write-ahead log is closed last. Modules still busy when ctx ends are closed at once, and the
+// first error is returned.
+func (h *Host) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down Web Host...")
+
+	// Waits for modules being started or stopped through the launcher
+	err := h.server.Shutdown(ctx)
+	if err != nil {
+		h.server.Close()
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	for _, m := range h.modules {
+		if stopErr := m.Stop(ctx); err == nil {
+			err = stopErr
 		}
 
-		h.hostStatus.Console = hs.Console
+		if drainErr := h.hub.Drain(ctx); err == nil {
+			err = drainErr
+		}
 	}
 
-	if h.hostStatus.WebSocket != hs.WebSocket {
-		if hs.WebSocket {
-			h.webSocket.Start()
-		} else {
-			h.webSocket.Stop()
+	if h.hub.Store != nil {
+		if storeErr := h.hub.Store.Close(); err == nil {
+			err = storeErr
 		}
+	}
+
+	log.Println("Web Host Stopped")
+
+	return err
+}
 
-		h.hostStatus.WebSocket = hs.WebSocket
+// module returns the registered module with the path, the lock must be held
+func (h *Host) module(path string) (module.Module, bool) {
+	for _, m := range h.modules {
+		if modulePath(m) == path {
+			return m, true
+		}
 	}
+
+	return nil, false
+}
+
+// modulePath names the module in its routes
+func modulePath(m module.Module) string {
+	return strings.ToLower(m.Name())
 }
 
 func (h *Host) mapRoutes() http.Handler {
@@ -100,14 +290,8 @@ func (h *Host) mapRoutes() http.Handler {
 
 	r.HandleFunc("/", h.homepageHandler)
 
-	r.HandleFunc("/api/start", h.startAPIHandler)
-	r.HandleFunc("/api/stop", h.stopAPIHandler)
-
-	r.HandleFunc("/websocket/start", h.startWebSocketHandler)
-	r.HandleFunc("/websocket/stop", h.stopWebSocketHandler)
-
-	r.HandleFunc("/console/start", h.startConsoleHandler)
-	r.HandleFunc("/console/stop", h.stopConsoleHandler)
+	r.HandleFunc("/{module}/start", h.startModuleHandler)
+	r.HandleFunc("/{module}/stop", h.stopModuleHandler)
 
 	return r
 }
@@ -123,63 +307,57 @@ func (h *Host) homepageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.Lock()
+	panels := make([]modulePanel, 0, len(h.modules))
+	for _, m := range h.modules {
+		panels = append(panels, modulePanel{Status: m.Status(), Name: m.Name(), Path: modulePath(m)})
+	}
+	h.Unlock()
+
 	data := struct {
-		API           bool
-		APIAddr       string
-		Console       bool
-		WebSocket     bool
-		WebSocketAddr string
+		Modules     []modulePanel
+		Subscribers []channel.SubscriberStats
+		Limited     bool
+		Clients     []ClientUsage
 	}{
-		API:           h.hostStatus.API,
-		APIAddr:       h.APIAddr,
-		Console:       h.hostStatus.Console,
-		WebSocket:     h.hostStatus.WebSocket,
-		WebSocketAddr: h.WebSocketAddr,
+		Modules:     panels,
+		Subscribers: h.hub.Stats(),
+		Limited:     h.api.Limiter != nil,
+		Clients:     h.api.Limiter.Usage(),
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	homepageTemplate.Execute(w, data)
 }
 
-func (h *Host) startAPIHandler(w http.ResponseWriter, r *http.Request) {
-	s := h.hostStatus
-	s.API = true
-	h.syncHostStatuses(s)
-	http.Redirect(w, r, "/", http.StatusFound)
+func (h *Host) startModuleHandler(w http.ResponseWriter, r *http.Request) {
+	h.changeModule(w, r, module.Module.Start)
 }
 
-func (h *Host) stopAPIHandler(w http.ResponseWriter, r *http.Request) {
-	s := h.hostStatus
-	s.API = false
-	h.syncHostStatuses(s)
-	http.Redirect(w, r, "/", http.StatusFound)
+func (h *Host) stopModuleHandler(w http.ResponseWriter, r *http.Request) {
+	h.changeModule(w, r, module.Module.Stop)
 }
 
-func (h *Host) startWebSocketHandler(w http.ResponseWriter, r *http.Request) {
-	s := h.hostStatus
-	s.WebSocket = true
-	h.syncHostStatuses(s)
-	http.Redirect(w, r, "/", http.StatusFound)
-}
+// changeModule starts or stops the module named by the route, then returns to the control panel
+func (h *Host) changeModule(w http.ResponseWriter, r *http.Request, change func(module.Module, context.Context) error) {
+	h.Lock()
+	defer h.Unlock()
 
-func (h *Host) stopWebSocketHandler(w http.ResponseWriter, r *http.Request) {
-	s := h.hostStatus
-	s.WebSocket = false
-	h.syncHostStatuses(s)
-	http.Redirect(w, r, "/", http.StatusFound)
-}
+	m, ok := h.module(mux.Vars(r)["module"])
+	if !ok {
+		http.Error(w, "Page not found", 404)
+		return
+	}
 
-func (h *Host) startConsoleHandler(w http.ResponseWriter, r *http.Request) {
-	s := h.hostStatus
-	s.Console = true
-	h.syncHostStatuses(s)
-	http.Redirect(w, r, "/", http.StatusFound)
-}
+	ctx, cancel := context.WithTimeout(r.Context(), changeTimeout)
+	defer cancel()
+
+	if err := change(m, ctx); err != nil {
+		log.Println(m.Name(), "failed:", err)
+		http.Error(w, fmt.Sprintf("%v failed: %v", m.Name(), err), http.StatusInternalServerError)
+		return
+	}
 
-func (h *Host) stopConsoleHandler(w http.ResponseWriter, r *http.Request) {
-	s := h.hostStatus
-	s.Console = false
-	h.syncHostStatuses(s)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -214,6 +392,7 @@ const launcherTemplate = `
   .panel { width: 200px; margin-left: 20px; }
   .panel-body { text-align: center; min-height: 100px; }
   .panel-body .host-location { display: block; margin-bottom: 10px; }
+  .subscribers, .clients { clear: both; margin: 0 20px 20px; width: auto; }
   </style>
 </head>
 <body>
@@ -224,18 +403,25 @@ const launcherTemplate = `
     </header>
 
     <div class="fluid">
+      {{ range .Modules }}
       <div class="panel panel-default pull-left">
-        {{ if .API }}
+        {{ if .Running }}
         <div class="panel-heading">
           <h3 class="panel-title">
-            API
+            {{ .Name }}
             <span class="label label-success pull-right">Running</span>
           </h3>
         </div>
         <div class="panel-body">
-          <span class="host-location">http://localhost{{ .APIAddr }}</span>
-          <a class="btn btn-default" href="api/stop">
-            Stop API
+          {{ if .Browsable }}
+          <a class="host-location" href="{{ .Location }}" target="_blank">{{ .Location }}</a>
+          {{ else if .Location }}
+          <span class="host-location">{{ .Location }}</span>
+          {{ else }}
+          <span class="host-location">&nbsp;</span>
+          {{ end }}
+          <a class="btn btn-default" href="{{ .Path }}/stop">
+            Stop {{ .Name }}
             &nbsp;
             <i class="fa fa-power-off"></i>
           </a>
@@ -243,91 +429,82 @@ const launcherTemplate = `
         {{ else }}
         <div class="panel-heading">
           <h3 class="panel-title">
-            API
+            {{ .Name }}
             <span class="label label-danger pull-right">Stopped</span>
           </h3>
         </div>
         <div class="panel-body">
           <span class="host-location">&nbsp;</span>
-          <a class="btn btn-default" href="api/start">
-            Start API
+          <a class="btn btn-default" href="{{ .Path }}/start">
+            Start {{ .Name }}
             &nbsp;
             <i class="fa fa-power-off"></i>
           </a>
         </div>
         {{ end }}
       </div>
+      {{ end }}
 
-      <div class="panel panel-default pull-left">
-        {{ if .WebSocket }}
+      <div class="panel panel-default subscribers">
         <div class="panel-heading">
-          <h3 class="panel-title">
-            WebSocket
-            <span class="label label-success pull-right">Running</span>
-          </h3>
-        </div>
-        <div class="panel-body">
-          <a class="host-location" href="http://localhost{{ .WebSocketAddr }}" target="_blank">http://localhost{{ .WebSocketAddr }}</a>
-          <a class="btn btn-default" href="websocket/stop">
-            Stop WebSocket
-            &nbsp;
-            <i class="fa fa-power-off"></i>
-          </a>
+          <h3 class="panel-title">Subscribers</h3>
         </div>
-        {{ else }}
-        <div class="panel-heading">
-          <h3 class="panel-title">
-            WebSocket
-            <span class="label label-danger pull-right">Stopped</span>
-          </h3>
-        </div>
-        <div class="panel-body">
-          <span class="host-location">&nbsp;</span>
-          <a class="btn btn-default" href="websocket/start">
-            Start WebSocket
-            &nbsp;
-            <i class="fa fa-power-off"></i>
-          </a>
-        </div>
-        {{ end }}
+        <table class="table">
+          <tr>
+            <th>Name</th>
+            <th>Topics</th>
+            <th>Policy</th>
+            <th>Queued</th>
+            <th>Dropped</th>
+          </tr>
+          {{ range .Subscribers }}
+          <tr{{ if .Dropped }} class="warning"{{ end }}>
+            <td>{{ .Name }}</td>
+            <td>{{ range .Topics }}<code>{{ . }}</code> {{ end }}</td>
+            <td>{{ .Policy }}</td>
+            <td>{{ .Queued }} / {{ .QueueSize }}</td>
+            <td>{{ .Dropped }}</td>
+          </tr>
+          {{ else }}
+          <tr>
+            <td colspan="5">No subscribers</td>
+          </tr>
+          {{ end }}
+        </table>
       </div>
 
-      <div class="panel panel-default pull-left">
-        {{ if .Console }}
-        <div class="panel-heading">
-          <h3 class="panel-title">
-            Console
-            <span class="label label-success pull-right">Running</span>
-          </h3>
-        </div>
-        <div class="panel-body">
-          <span class="host-location">&nbsp;</span>
-          <a class="btn btn-default" href="console/stop">
-            Stop Console
-            &nbsp;
-            <i class="fa fa-power-off"></i>
-          </a>
-        </div>
-        {{ else }}
+      {{ if .Limited }}
+      <div class="panel panel-default clients">
         <div class="panel-heading">
-          <h3 class="panel-title">
-            Console
-            <span class="label label-danger pull-right">Stopped</span>
-          </h3>
-        </div>
-        <div class="panel-body">
-          <span class="host-location">&nbsp;</span>
-          <a class="btn btn-default" href="console/start">
-            Start Console
-            &nbsp;
-            <i class="fa fa-power-off"></i>
-          </a>
+          <h3 class="panel-title">API Clients</h3>
         </div>
-        {{ end }}
+        <table class="table">
+          <tr>
+            <th>Client</th>
+            <th>Today</th>
+            <th>This Month</th>
+            <th>Throttled</th>
+            <th>Last Throttled</th>
+          </tr>
+          {{ range .Clients }}
+          <tr{{ if .Throttled }} class="warning"{{ end }}>
+            <td>{{ .Client }}</td>
+            <td>{{ .DailyMessages }} messages, {{ .DailyBytes }} bytes</td>
+            <td>{{ .MonthlyMessages }} messages, {{ .MonthlyBytes }} bytes</td>
+            <td>{{ .Throttled }}</td>
+            <td>{{ if .Throttled }}{{ .LastThrottled.Format "2006-01-02 15:04:05" }}{{ end }}</td>
+          </tr>
+          {{ else }}
+          <tr>
+            <td colspan="5">No clients have published</td>
+          </tr>
+          {{ end }}
+        </table>
       </div>
+      {{ end }}
 
     </div>
     <!-- <script src="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.5/js/bootstrap.min.js" integrity="sha256-Sk3nkD6mLTMOF0EOpNtsIry+s1CsaqQC1rVLTAy+0yc= sha512-K1qjQ+NcF2TYO/eI3M6v8EiNYZfA95pQumfvcVrTHtwQVDG+aHRqLi/ETn2uB+1JqwYqVG3LIvdm9lj6imS/pQ==" crossorigin="anonymous"></script> -->
 </body>
 </html>
-`
\ No newline at end of file
+`
@@ -0,0 +1,163 @@
+package hosts
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/benjamingram/stem/channel"
+	"github.com/benjamingram/stem/module"
+)
+
+// fakeModule records when it is started and stopped
+type fakeModule struct {
+	name    string
+	running bool
+	events  *[]string
+}
+
+func (f *fakeModule) Name() string {
+	return f.name
+}
+
+func (f *fakeModule) Start(ctx context.Context) error {
+	f.running = true
+	*f.events = append(*f.events, "start "+f.name)
+
+	return nil
+}
+
+func (f *fakeModule) Stop(ctx context.Context) error {
+	if f.running {
+		f.running = false
+		*f.events = append(*f.events, "stop "+f.name)
+	}
+
+	return nil
+}
+
+func (f *fakeModule) Status() module.Status {
+	return module.Status{Running: f.running, Location: "fake://" + f.name}
+}
+
+func launch(h *Host, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+
+	return w
+}
+
+func TestRegisteredModulesAreControlledByTheLauncher(t *testing.T) {
+	h := Host{}
+	h.Initialize(HostStatus{})
+
+	var events []string
+	if err := h.Register(&fakeModule{name: "Recorder", events: &events}); err != nil {
+		t.Fatalf("Register(Recorder) = %v, want nil", err)
+	}
+
+	if w := launch(&h, "/"); !strings.Contains(w.Body.String(), "Start Recorder") || !strings.Contains(w.Body.String(), `href="recorder/start"`) {
+		t.Errorf("GET /; Body does not offer to start Recorder")
+	}
+
+	if w := launch(&h, "/recorder/start"); w.Code != http.StatusFound {
+		t.Errorf("GET /recorder/start; Code = %v, want %v", w.Code, http.StatusFound)
+	}
+
+	if body := launch(&h, "/").Body.String(); !strings.Contains(body, "Stop Recorder") || !strings.Contains(body, "fake://Recorder") {
+		t.Errorf("GET / after start; Body does not show Recorder running")
+	}
+
+	if w := launch(&h, "/missing/start"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /missing/start; Code = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() = %v, want nil", err)
+	}
+
+	if want := []string{"start Recorder", "stop Recorder"}; strings.Join(events, ", ") != strings.Join(want, ", ") {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
+
+func TestSourcesStopBeforeSinks(t *testing.T) {
+	h := Host{}
+	h.Initialize(HostStatus{})
+
+	var events []string
+	for _, m := range []*fakeModule{{name: "Sink", events: &events}, {name: "Source", events: &events}} {
+		if m.name == "Source" {
+			h.RegisterSource(m)
+		} else {
+			h.Register(m)
+		}
+		m.Start(context.Background())
+	}
+
+	h.Shutdown(context.Background())
+
+	if want := "start Sink, start Source, stop Source, stop Sink"; strings.Join(events, ", ") != want {
+		t.Errorf("events = %v, want %v", strings.Join(events, ", "), want)
+	}
+}
+
+func TestModulesRegisteredBeforeInitializeAreKept(t *testing.T) {
+	h := Host{}
+
+	var events []string
+	h.Register(&fakeModule{name: "Recorder", events: &events})
+	h.RegisterSource(&fakeModule{name: "Source", events: &events})
+
+	h.Initialize(HostStatus{"Recorder": true})
+	defer h.Shutdown(context.Background())
+
+	names := make([]string, 0, len(h.modules))
+	for _, m := range h.modules {
+		names = append(names, m.Name())
+	}
+
+	if want := "Source, API, Recorder, WebSocket, SSE, Console"; strings.Join(names, ", ") != want {
+		t.Errorf("modules = %v, want %v", strings.Join(names, ", "), want)
+	}
+
+	if want := "start Recorder"; strings.Join(events, ", ") != want {
+		t.Errorf("events = %v, want %v", strings.Join(events, ", "), want)
+	}
+}
+
+func TestRegisterRejectsInvalidNames(t *testing.T) {
+	h := Host{}
+	h.Initialize(HostStatus{})
+
+	var events []string
+	for _, name := range []string{"", "a/b", "api", "Console"} {
+		if err := h.Register(&fakeModule{name: name, events: &events}); err == nil {
+			t.Errorf("Register(%q) = nil, want error", name)
+		}
+	}
+}
+
+func TestHomepageEscapesSubscribers(t *testing.T) {
+	h := Host{}
+	h.Initialize(HostStatus{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	markup := "<script>alert(1)</script>"
+	if _, err := h.Hub().SubscribeWith(ctx, []string{markup}, channel.Name(markup)); err != nil {
+		t.Fatalf("SubscribeWith(%v) = %v, want nil", markup, err)
+	}
+
+	body := launch(&h, "/").Body.String()
+	if strings.Contains(body, markup) {
+		t.Errorf("GET /; Body contains unescaped %v", markup)
+	}
+
+	if !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("GET /; Body does not show the escaped subscriber")
+	}
+}
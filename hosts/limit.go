@@ -0,0 +1,262 @@
+package hosts
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+// maxTrackedAddresses is how many remote addresses are tracked before the one seen longest ago is forgotten
+const maxTrackedAddresses = 10000
+
+// Limits is how much a single client may publish, zero values are unlimited
+type Limits struct {
+	// Rate is the sustained number of messages per second and Burst how many may be sent at once,
+	// Burst defaults to Rate rounded up
+	Rate  float64
+	Burst int
+
+	DailyMessages   int64
+	DailyBytes      int64
+	MonthlyMessages int64
+	MonthlyBytes    int64
+}
+
+// IsZero reports whether the limits leave clients unlimited
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// ClientUsage is what a client has published and how often it was throttled
+type ClientUsage struct {
+	Client          string
+	DailyMessages   int64
+	DailyBytes      int64
+	MonthlyMessages int64
+	MonthlyBytes    int64
+	Throttled       uint64
+	LastThrottled   time.Time
+}
+
+// Limiter enforces token bucket rate limits and daily and monthly quotas per API key and per
+// remote address. A request using a key must stay within both its key's and its address's limits.
+type Limiter struct {
+	sync.Mutex
+	clients map[string]*client
+	// addresses orders the tracked addresses from most to least recently seen
+	addresses *list.List
+	// maxAddresses bounds the tracked addresses, defaults to maxTrackedAddresses
+	maxAddresses int
+
+	Key     Limits
+	Address Limits
+}
+
+type client struct {
+	usage  ClientUsage
+	limits Limits
+	tokens float64
+	last   time.Time
+	day    string
+	month  string
+
+	// seen is the client's place in Limiter.addresses, nil for API keys
+	seen *list.Element
+}
+
+// limitError is returned when a client is over its limits, the request may be retried after retryAfter
+type limitError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+// Usage returns the usage of every tracked client, the most throttled first
+func (l *Limiter) Usage() []ClientUsage {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	usage := make([]ClientUsage, 0, len(l.clients))
+	for _, c := range l.clients {
+		usage = append(usage, c.usage)
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Throttled != usage[j].Throttled {
+			return usage[i].Throttled > usage[j].Throttled
+		}
+
+		return usage[i].Client < usage[j].Client
+	})
+
+	return usage
+}
+
+// take spends one message of size bytes from the limits of the key, if any, and the remote
+// address. Nothing is spent unless every limit allows it.
+func (l *Limiter) take(key *APIKey, remoteAddr string, size int, now time.Time) *limitError {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.clients == nil {
+		l.clients = make(map[string]*client)
+		l.addresses = list.New()
+	}
+
+	clients := make([]*client, 0, 2)
+
+	// Clients are named like the publishers of their messages
+	if key != nil && !l.Key.IsZero() {
+		clients = append(clients, l.client(channel.KeyPublisher(key.Name), l.Key, false, now))
+	}
+
+	if !l.Address.IsZero() {
+		clients = append(clients, l.client(channel.AddressPublisher(remoteAddr), l.Address, true, now))
+	}
+
+	for _, c := range clients {
+		if err := c.check(int64(size), now); err != nil {
+			c.usage.Throttled++
+			c.usage.LastThrottled = now
+
+			return err
+		}
+	}
+
+	for _, c := range clients {
+		c.spend(int64(size))
+	}
+
+	return nil
+}
+
+// client returns the tracked client, the lock must be held
+func (l *Limiter) client(name string, limits Limits, address bool, now time.Time) *client {
+	if c, ok := l.clients[name]; ok {
+		if c.seen != nil {
+			l.addresses.MoveToFront(c.seen)
+		}
+
+		return c
+	}
+
+	c := &client{usage: ClientUsage{Client: name}, limits: limits, tokens: float64(limits.burst()), last: now}
+	l.clients[name] = c
+
+	if address {
+		l.forgetLeastRecent()
+		c.seen = l.addresses.PushFront(c)
+	}
+
+	return c
+}
+
+// forgetLeastRecent makes room for another address by no longer tracking the addresses seen
+// longest ago. Their quotas only start over once as many other addresses have published since.
+// The lock must be held.
+func (l *Limiter) forgetLeastRecent() {
+	limit := l.maxAddresses
+	if limit < 1 {
+		limit = maxTrackedAddresses
+	}
+
+	for l.addresses.Len() >= limit {
+		c := l.addresses.Remove(l.addresses.Back()).(*client)
+		delete(l.clients, c.usage.Client)
+	}
+}
+
+// check refills the bucket, rolls the quotas over at the start of a day or month and reports
+// whether another message of size bytes is allowed
+func (c *client) check(size int64, now time.Time) *limitError {
+	if c.limits.Rate > 0 {
+		c.tokens = math.Min(float64(c.limits.burst()), c.tokens+now.Sub(c.last).Seconds()*c.limits.Rate)
+	}
+	c.last = now
+
+	utc := now.UTC()
+	if day := utc.Format("2006-01-02"); day != c.day {
+		c.day = day
+		c.usage.DailyMessages = 0
+		c.usage.DailyBytes = 0
+	}
+
+	if month := utc.Format("2006-01"); month != c.month {
+		c.month = month
+		c.usage.MonthlyMessages = 0
+		c.usage.MonthlyBytes = 0
+	}
+
+	if c.limits.Rate > 0 && c.tokens < 1 {
+		wait := time.Duration((1 - c.tokens) / c.limits.Rate * float64(time.Second))
+		return &limitError{fmt.Sprintf("rate limit of %v messages per second exceeded by %v", c.limits.Rate, c.usage.Client), wait}
+	}
+
+	tomorrow := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+	if exceeded(c.usage.DailyMessages+1, c.limits.DailyMessages) || exceeded(c.usage.DailyBytes+size, c.limits.DailyBytes) {
+		return &limitError{fmt.Sprintf("daily quota exceeded by %v", c.usage.Client), tomorrow.Sub(now)}
+	}
+
+	nextMonth := time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	if exceeded(c.usage.MonthlyMessages+1, c.limits.MonthlyMessages) || exceeded(c.usage.MonthlyBytes+size, c.limits.MonthlyBytes) {
+		return &limitError{fmt.Sprintf("monthly quota exceeded by %v", c.usage.Client), nextMonth.Sub(now)}
+	}
+
+	return nil
+}
+
+func (c *client) spend(size int64) {
+	if c.limits.Rate > 0 {
+		c.tokens--
+	}
+
+	c.usage.DailyMessages++
+	c.usage.DailyBytes += size
+	c.usage.MonthlyMessages++
+	c.usage.MonthlyBytes += size
+}
+
+func (l Limits) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+
+	return int(math.Ceil(l.Rate))
+}
+
+func exceeded(value int64, limit int64) bool {
+	return limit > 0 && value > limit
+}
+
+// tooManyRequests answers 429 Too Many Requests with a Retry-After header in whole seconds
+func tooManyRequests(w http.ResponseWriter, err *limitError) {
+	setRetryAfter(w, err)
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+func setRetryAfter(w http.ResponseWriter, err *limitError) {
+	seconds := int(math.Ceil(err.retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,122 @@
+package hosts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+func TestLimiterTokenBucket(t *testing.T) {
+	l := Limiter{Address: Limits{Rate: 1, Burst: 2}}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if err := l.take(nil, "10.0.0.1:1234", 1, now); err != nil {
+			t.Fatalf("take() %v within burst = %v, want nil", i, err)
+		}
+	}
+
+	err := l.take(nil, "10.0.0.1:5678", 1, now)
+	if err == nil || err.retryAfter != time.Second {
+		t.Fatalf("take() over burst = %v, want retry after 1s", err)
+	}
+
+	if err := l.take(nil, "10.0.0.2:1234", 1, now); err != nil {
+		t.Errorf("take() from another address = %v, want nil", err)
+	}
+
+	if err := l.take(nil, "10.0.0.1:1234", 1, now.Add(time.Second)); err != nil {
+		t.Errorf("take() after refill = %v, want nil", err)
+	}
+
+	if usage := l.Usage(); len(usage) != 2 || usage[0].Client != "address 10.0.0.1" || usage[0].Throttled != 1 || usage[0].DailyMessages != 3 {
+		t.Errorf("Usage() = %+v, want address 10.0.0.1 first with 3 messages, 1 throttled", usage)
+	}
+}
+
+func TestLimiterQuotas(t *testing.T) {
+	key := &APIKey{Name: "collector"}
+	l := Limiter{Key: Limits{DailyMessages: 2, MonthlyBytes: 10}}
+	now := time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)
+
+	l.take(key, "10.0.0.1:1234", 4, now)
+	l.take(key, "10.0.0.1:1234", 4, now)
+
+	err := l.take(key, "10.0.0.1:1234", 1, now)
+	if err == nil || err.retryAfter != time.Hour {
+		t.Fatalf("take() over daily quota = %v, want retry after 1h", err)
+	}
+
+	now = now.Add(time.Hour)
+	if err := l.take(key, "10.0.0.1:1234", 1, now); err != nil {
+		t.Errorf("take() on a new day and month = %v, want nil", err)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if err := l.take(key, "10.0.0.1:1234", 10, now); err == nil || !strings.Contains(err.Error(), "monthly") {
+		t.Errorf("take() over monthly bytes = %v, want monthly quota error", err)
+	}
+}
+
+func TestLimiterKeepsQuotasOfRecentAddresses(t *testing.T) {
+	l := Limiter{Address: Limits{MonthlyMessages: 1}, maxAddresses: 3}
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	l.take(nil, "10.0.0.1:1234", 1, now)
+
+	now = now.Add(24 * time.Hour)
+	l.take(nil, "10.0.0.2:1234", 1, now)
+	l.take(nil, "10.0.0.3:1234", 1, now)
+
+	now = now.Add(24 * time.Hour)
+	if err := l.take(nil, "10.0.0.1:1234", 1, now); err == nil {
+		t.Errorf("take() over monthly quota a day later = nil, want error")
+	}
+
+	l.take(nil, "10.0.0.4:1234", 1, now)
+
+	if err := l.take(nil, "10.0.0.1:1234", 1, now); err == nil {
+		t.Errorf("take() over monthly quota once another address is tracked = nil, want error")
+	}
+
+	if usage := l.Usage(); len(usage) != 3 {
+		t.Errorf("Usage() tracks %v addresses, want 3", len(usage))
+	}
+}
+
+func TestRootHandlerThrottles(t *testing.T) {
+	api := API{Hub: &channel.Hub{}, Limiter: &Limiter{Address: Limits{Rate: 0.1, Burst: 1}}}
+
+	publish := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.rootHandler(w, httptest.NewRequest("POST", "/topics/sensors/temp", strings.NewReader("21.5")))
+		return w
+	}
+
+	if w := publish(); w.Code != http.StatusOK {
+		t.Fatalf("POST within limit; Code = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	w := publish()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("POST over limit; Code = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+
+	if retry := w.Header().Get("Retry-After"); retry != "10" {
+		t.Errorf("POST over limit; Retry-After = %q, want 10", retry)
+	}
+
+	r := httptest.NewRequest("POST", "/topics/sensors/temp", strings.NewReader("{\"payload\": 1}\n{\"payload\": 2}"))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+
+	w = httptest.NewRecorder()
+	api.rootHandler(w, r)
+
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("POST batch over limit; Code = %v, Retry-After = %q, want %v", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+}
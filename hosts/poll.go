@@ -0,0 +1,168 @@
+package hosts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+const (
+	// AfterParam fetches only messages published after the sequence number
+	AfterParam = "after"
+	// TimeoutParam shortens how long a fetch waits for messages, e.g. timeout=10s
+	TimeoutParam = "timeout"
+	// DefaultPollTimeout is the longest a fetch waits for messages unless API.PollTimeout is set
+	DefaultPollTimeout = 30 * time.Second
+
+	// maxPollBatch bounds the number of messages returned by a single fetch
+	maxPollBatch = 100
+)
+
+// polledMessage is a message as returned by a fetch
+type polledMessage struct {
+	Sequence    uint64            `json:"sequence"`
+	ID          string            `json:"id"`
+	Topic       string            `json:"topic"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Payload     string            `json:"payload"`
+	Encoding    string            `json:"encoding,omitempty"`
+	Retain      bool              `json:"retain,omitempty"`
+}
+
+// pollHandler long-polls for messages on the requested topic filter, e.g. GET /topics/sensors/#?after=42.
+// Messages still held in history are returned at once, otherwise the request waits for the next
+// message until it times out with 204 No Content. The client fetches again after the last sequence returned.
+func (api *API) pollHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := requestTopicFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, err := requestAfter(r, api.Hub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := api.requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	s, err := api.Hub.SubscribeWith(ctx, []string{filter},
+		channel.Name("poll "+r.RemoteAddr),
+		channel.From(from))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer s.Unsubscribe()
+
+	messages := make([]polledMessage, 0)
+
+	// Wait for the first message, then take whatever else is already queued
+	select {
+	case message, ok := <-s.C:
+		if ok {
+			messages = append(messages, newPolledMessage(message))
+		}
+	case <-ctx.Done():
+	}
+
+	for len(messages) > 0 && len(messages) < maxPollBatch {
+		message, ok := receiveQueued(s)
+		if !ok {
+			break
+		}
+
+		messages = append(messages, newPolledMessage(message))
+	}
+
+	if len(messages) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// receiveQueued returns the subscription's next message without waiting for one
+func receiveQueued(s *channel.Subscription) (channel.Message, bool) {
+	select {
+	case message, ok := <-s.C:
+		return message, ok
+	default:
+		return channel.Message{}, false
+	}
+}
+
+func newPolledMessage(message channel.Message) polledMessage {
+	payload, encoding := message.EncodedPayload()
+
+	return polledMessage{
+		Sequence:    message.Sequence,
+		ID:          message.ID,
+		Topic:       message.Topic,
+		Timestamp:   message.Timestamp,
+		Headers:     message.Headers,
+		ContentType: message.ContentType,
+		Payload:     payload,
+		Encoding:    encoding,
+		Retain:      message.Retain,
+	}
+}
+
+// requestAfter reads where the fetch starts from the AfterParam. Without it the fetch returns
+// the retained values of the topics or waits for the next message. A sequence ahead of the Hub
+// fetches from the earliest history.
+func requestAfter(r *http.Request, hub *channel.Hub) (channel.Offset, error) {
+	value := r.URL.Query().Get(AfterParam)
+	if value == "" {
+		return channel.Latest(), nil
+	}
+
+	after, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return channel.Latest(), fmt.Errorf("invalid after sequence %q", value)
+	}
+
+	return hub.After(after), nil
+}
+
+// requestTimeout reads the TimeoutParam, which may shorten but never extend the API's PollTimeout
+func (api *API) requestTimeout(r *http.Request) (time.Duration, error) {
+	timeout := api.PollTimeout
+	if timeout <= 0 {
+		timeout = DefaultPollTimeout
+	}
+
+	value := r.URL.Query().Get(TimeoutParam)
+	if value == "" {
+		return timeout, nil
+	}
+
+	requested, err := time.ParseDuration(value)
+	if err != nil || requested < 0 {
+		return 0, fmt.Errorf("invalid timeout %q", value)
+	}
+
+	if requested < timeout {
+		timeout = requested
+	}
+
+	return timeout, nil
+}
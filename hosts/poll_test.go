@@ -0,0 +1,150 @@
+package hosts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+func poll(api *API, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	api.rootHandler(w, httptest.NewRequest("GET", target, nil))
+
+	return w
+}
+
+func decodePolled(t *testing.T, w *httptest.ResponseRecorder) []polledMessage {
+	var messages []polledMessage
+	if err := json.NewDecoder(w.Body).Decode(&messages); err != nil {
+		t.Fatalf("Decode() = %v, want JSON batch", err)
+	}
+
+	return messages
+}
+
+func TestPollReturnsHistoryAfterSequence(t *testing.T) {
+	hub := channel.Hub{HistorySize: 10}
+	api := API{Hub: &hub}
+
+	hub.SendMessage("one", "sensors/temp")
+	hub.SendMessage("on", "actuators/fan")
+	hub.SendMessage("two", "sensors/humidity")
+
+	w := poll(&api, "/topics/sensors/%23?after=0")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /topics/sensors/#?after=0; Code = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	messages := decodePolled(t, w)
+	if len(messages) != 2 || messages[0].Payload != "one" || messages[1].Payload != "two" || messages[1].Sequence != 3 {
+		t.Errorf("GET /topics/sensors/#?after=0; Received = %+v, want one, two", messages)
+	}
+
+	w = poll(&api, "/topics/sensors/%23?after=1")
+	if messages := decodePolled(t, w); len(messages) != 1 || messages[0].Payload != "two" {
+		t.Errorf("GET /topics/sensors/#?after=1; Received = %+v, want two", messages)
+	}
+}
+
+func TestPollAfterSequenceAheadOfHubReturnsEarliestHistory(t *testing.T) {
+	hub := channel.Hub{HistorySize: 10}
+	api := API{Hub: &hub}
+
+	hub.SendMessage("one", "sensors/temp")
+	hub.SendMessage("two", "sensors/temp")
+
+	for _, after := range []string{"500", "18446744073709551615"} {
+		w := poll(&api, "/topics/sensors/temp?after="+after)
+		if messages := decodePolled(t, w); len(messages) != 2 || messages[0].Payload != "one" || messages[1].Payload != "two" {
+			t.Errorf("GET /topics/sensors/temp?after=%v; Received = %+v, want one, two", after, messages)
+		}
+	}
+}
+
+func TestPollWaitsForNextMessage(t *testing.T) {
+	hub := channel.Hub{}
+	api := API{Hub: &hub}
+
+	go func() {
+		for len(hub.Stats()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		hub.SendMessage("21.5", "sensors/temp")
+	}()
+
+	w := poll(&api, "/topics/sensors/temp?timeout=5s")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /topics/sensors/temp; Code = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	if messages := decodePolled(t, w); len(messages) != 1 || messages[0].Payload != "21.5" {
+		t.Errorf("GET /topics/sensors/temp; Received = %+v, want 21.5", messages)
+	}
+}
+
+func TestPollTimesOutWithNoContent(t *testing.T) {
+	api := API{Hub: &channel.Hub{}, PollTimeout: 10 * time.Millisecond}
+
+	if w := poll(&api, "/topics/sensors/temp?timeout=1h"); w.Code != http.StatusNoContent {
+		t.Errorf("GET /topics/sensors/temp; Code = %v, want %v", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestPollRejectsInvalidRequests(t *testing.T) {
+	api := API{Hub: &channel.Hub{}}
+
+	for _, target := range []string{
+		"/topics/sensors/te%23mp",
+		"/topics/sensors/temp?after=last",
+		"/topics/sensors/temp?timeout=soon",
+	} {
+		if w := poll(&api, target); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %v; Code = %v, want %v", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestStopAnswersWaitingPolls(t *testing.T) {
+	api := API{Addr: "127.0.0.1:0", Hub: &channel.Hub{}}
+	if err := api.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "http://" + api.listener.Addr().String() + "/topics/sensors/temp?timeout=1m"
+
+	polled := make(chan int)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			polled <- 0
+			return
+		}
+		resp.Body.Close()
+
+		polled <- resp.StatusCode
+	}()
+
+	// Give the poll time to start waiting
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := api.Stop(ctx); err != nil {
+		t.Errorf("Stop() = %v, want nil", err)
+	}
+
+	if code := <-polled; code != http.StatusNoContent {
+		t.Errorf("GET during Stop(); StatusCode = %v, want %v", code, http.StatusNoContent)
+	}
+
+	if _, err := http.Get(url); err == nil {
+		t.Error("GET after Stop() = nil, want error")
+	}
+}
@@ -0,0 +1,360 @@
+package hosts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+const (
+	// webhooksPath prefixes the request path of webhook deliveries, e.g. POST /webhooks/github
+	webhooksPath = "/webhooks/"
+
+	// GitHubScheme verifies the X-Hub-Signature-256 header sent by GitHub
+	GitHubScheme = "github"
+	// StripeScheme verifies the timestamped Stripe-Signature header sent by Stripe
+	StripeScheme = "stripe"
+
+	// DefaultWebhookTolerance is how far a delivery's timestamp may be from now, and how long
+	// deliveries are remembered to reject replays, unless Webhooks.Tolerance is set
+	DefaultWebhookTolerance = 5 * time.Minute
+
+	// maxWebhookSize bounds the body of a delivery, GitHub caps payloads at 25MB
+	maxWebhookSize = 25 * 1024 * 1024
+)
+
+// Webhook is a third-party sender whose signed deliveries are published to Topic
+type Webhook struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+	Scheme string `json:"scheme"`
+
+	// Topic is where deliveries are published, defaults to webhooks/<name>. Deliveries to
+	// /webhooks/<name>/<path> or carrying an event type are published below it.
+	Topic string `json:"topic,omitempty"`
+
+	// EventHeader names the header holding the event type, defaults to X-GitHub-Event for GitHub
+	EventHeader string `json:"eventHeader,omitempty"`
+}
+
+// Webhooks verifies deliveries to the configured webhooks
+type Webhooks struct {
+	sync.Mutex
+	hooks map[string]Webhook
+	seen  map[string]time.Time
+
+	// Tolerance defaults to DefaultWebhookTolerance
+	Tolerance time.Duration
+}
+
+// NewWebhooks checks the webhooks and returns Webhooks verifying them
+func NewWebhooks(hooks []Webhook) (*Webhooks, error) {
+	wh := &Webhooks{hooks: make(map[string]Webhook, len(hooks)), seen: make(map[string]time.Time)}
+
+	for _, hook := range hooks {
+		if hook.Name == "" || strings.Contains(hook.Name, "/") {
+			return nil, fmt.Errorf("invalid webhook name %q", hook.Name)
+		}
+
+		if _, ok := wh.hooks[hook.Name]; ok {
+			return nil, fmt.Errorf("webhook %q is configured twice", hook.Name)
+		}
+
+		if hook.Secret == "" {
+			return nil, fmt.Errorf("webhook %q has no secret", hook.Name)
+		}
+
+		switch hook.Scheme {
+		case GitHubScheme:
+			if hook.EventHeader == "" {
+				hook.EventHeader = "X-GitHub-Event"
+			}
+		case StripeScheme:
+		default:
+			return nil, fmt.Errorf("webhook %q has unknown scheme %q", hook.Name, hook.Scheme)
+		}
+
+		if hook.Topic == "" {
+			hook.Topic = "webhooks/" + hook.Name
+		}
+
+		if err := channel.ValidateTopic(hook.Topic); err != nil {
+			return nil, fmt.Errorf("webhook %q: %v", hook.Name, err)
+		}
+
+		wh.hooks[hook.Name] = hook
+	}
+
+	return wh, nil
+}
+
+// LoadWebhooks reads a JSON file of webhooks, e.g.
+//
+//	{"webhooks": [{"name": "github", "secret": "s3cret", "scheme": "github"}]}
+func LoadWebhooks(path string) (*Webhooks, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("reading webhooks from %v: %v", path, err)
+	}
+
+	return NewWebhooks(config.Webhooks)
+}
+
+// webhookHandler publishes a delivery once its signature is verified. Deliveries are
+// authenticated by their signature, so API keys are not required.
+func (api *API) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	name, path := splitWebhookPath(r.URL.Path)
+
+	hook, ok := api.Webhooks.hook(name)
+	if !ok {
+		http.Error(w, "Page not found", 404)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, "Failed to read delivery", http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := api.Webhooks.verify(hook, r, body, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// A delivery that is not published may be retried by its sender
+	published := false
+	defer func() {
+		if !published {
+			api.Webhooks.forget(delivery)
+		}
+	}()
+
+	event := r.Header.Get(hook.EventHeader)
+
+	topic := hook.Topic
+	switch {
+	case path != "":
+		topic += "/" + path
+	case hook.EventHeader != "" && event != "":
+		topic += "/" + event
+	}
+
+	if err := channel.ValidateTopic(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = channel.DetectContentType(body)
+	}
+
+	if err := channel.ValidatePayload(contentType, body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if limited := api.Limiter.take(nil, r.RemoteAddr, len(body), time.Now()); limited != nil {
+		tooManyRequests(w, limited)
+		return
+	}
+
+	headers := map[string]string{"Source": r.RemoteAddr, "Webhook": hook.Name}
+	if event != "" {
+		headers["Event"] = event
+	}
+
+	_, err = api.Hub.Publish(channel.Message{
+		Topic:       topic,
+		Headers:     headers,
+		Payload:     body,
+		ContentType: contentType,
+	})
+
+	if err != nil {
+		log.Println("API failed to publish webhook:", err)
+		http.Error(w, "Failed to publish message", http.StatusInternalServerError)
+		return
+	}
+
+	published = true
+	w.WriteHeader(http.StatusOK)
+}
+
+func (wh *Webhooks) hook(name string) (Webhook, bool) {
+	if wh == nil {
+		return Webhook{}, false
+	}
+
+	hook, ok := wh.hooks[name]
+
+	return hook, ok
+}
+
+// verify checks the delivery's signature for the hook's scheme and rejects stale or replayed
+// deliveries. It returns the delivery's id, which should be forgotten if it is not published.
+func (wh *Webhooks) verify(hook Webhook, r *http.Request, body []byte, now time.Time) (string, error) {
+	var id string
+	var err error
+
+	switch hook.Scheme {
+	case GitHubScheme:
+		id, err = verifyGitHub(hook.Secret, r, body)
+	case StripeScheme:
+		id, err = verifyStripe(hook.Secret, r, body, now, wh.tolerance())
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	id = hook.Name + " " + id
+
+	return id, wh.remember(id, now)
+}
+
+// remember records the delivery, failing if it was already seen within the tolerance
+func (wh *Webhooks) remember(id string, now time.Time) error {
+	wh.Lock()
+	defer wh.Unlock()
+
+	for seen, at := range wh.seen {
+		if now.Sub(at) > wh.tolerance() {
+			delete(wh.seen, seen)
+		}
+	}
+
+	if _, ok := wh.seen[id]; ok {
+		return errors.New("delivery has already been received")
+	}
+
+	wh.seen[id] = now
+
+	return nil
+}
+
+// forget drops a delivery that was not published, so its sender's retry is accepted
+func (wh *Webhooks) forget(id string) {
+	wh.Lock()
+	defer wh.Unlock()
+
+	delete(wh.seen, id)
+}
+
+func (wh *Webhooks) tolerance() time.Duration {
+	if wh.Tolerance > 0 {
+		return wh.Tolerance
+	}
+
+	return DefaultWebhookTolerance
+}
+
+// verifyGitHub checks the X-Hub-Signature-256 header and returns the signature
+func verifyGitHub(secret string, r *http.Request, body []byte) (string, error) {
+	signature := r.Header.Get("X-Hub-Signature-256")
+	if !strings.HasPrefix(signature, "sha256=") {
+		return "", errors.New("missing X-Hub-Signature-256 signature")
+	}
+
+	if !validSignature(secret, body, strings.TrimPrefix(signature, "sha256=")) {
+		return "", errors.New("invalid signature")
+	}
+
+	// X-GitHub-Delivery is not signed and could be changed on a replay, so deliveries are told
+	// apart by their signature. GitHub deliveries carry no timestamp, so only replays within
+	// the tolerance can be spotted.
+	return signature, nil
+}
+
+// verifyStripe checks the Stripe-Signature header, t=<unix time>,v1=<signature>, whose
+// signature covers the timestamp and body. It returns the signature that matched.
+func verifyStripe(secret string, r *http.Request, body []byte, now time.Time, tolerance time.Duration) (string, error) {
+	var timestamp string
+	var signatures []string
+
+	for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	if timestamp == "" || len(signatures) == 0 {
+		return "", errors.New("missing Stripe-Signature timestamp or signature")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid Stripe-Signature timestamp %q", timestamp)
+	}
+
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return "", fmt.Errorf("timestamp is outside the %v tolerance", tolerance)
+	}
+
+	signed := append([]byte(timestamp+"."), body...)
+	for _, signature := range signatures {
+		if validSignature(secret, signed, signature) {
+			return signature, nil
+		}
+	}
+
+	return "", errors.New("invalid signature")
+}
+
+// validSignature compares the hex HMAC-SHA256 signature of data in constant time
+func validSignature(secret string, data []byte, signature string) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+
+	return hmac.Equal(mac.Sum(nil), got)
+}
+
+// splitWebhookPath splits /webhooks/<name>/<path> into the webhook name and the optional path
+func splitWebhookPath(path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, webhooksPath), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
@@ -0,0 +1,166 @@
+package hosts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamingram/stem/channel"
+)
+
+func sign(secret string, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookAPI(t *testing.T) (*API, chan channel.Message) {
+	webhooks, err := NewWebhooks([]Webhook{
+		{Name: "github", Secret: "github-secret", Scheme: GitHubScheme},
+		{Name: "stripe", Secret: "stripe-secret", Scheme: StripeScheme, Topic: "payments"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hub channel.Hub
+
+	c := make(chan channel.Message, 10)
+	hub.RegisterMessageChannel(&c, []string{"#"})
+
+	return &API{Hub: &hub, Webhooks: webhooks, Keys: testKeys(t)}, c
+}
+
+func deliver(api *API, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	api.rootHandler(w, r)
+
+	return w
+}
+
+func TestGitHubWebhook(t *testing.T) {
+	api, c := webhookAPI(t)
+
+	body := `{"action": "opened"}`
+	headers := map[string]string{
+		"X-Hub-Signature-256": "sha256=" + sign("github-secret", body),
+		"X-GitHub-Event":      "pull_request",
+		"X-GitHub-Delivery":   "1",
+	}
+
+	if w := deliver(api, "/webhooks/github", body, headers); w.Code != http.StatusOK {
+		t.Fatalf("POST /webhooks/github; Code = %v, want %v: %v", w.Code, http.StatusOK, w.Body)
+	}
+
+	if m := <-c; m.Topic != "webhooks/github/pull_request" || m.String() != body || m.Headers["Event"] != "pull_request" {
+		t.Errorf("POST /webhooks/github; Received = %v: %v %v, want webhooks/github/pull_request", m.Topic, m, m.Headers)
+	}
+
+	if w := deliver(api, "/webhooks/github", body, headers); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /webhooks/github replayed; Code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	headers["X-GitHub-Delivery"] = "2"
+	headers["X-GitHub-Event"] = "anything"
+
+	if w := deliver(api, "/webhooks/github", body, headers); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /webhooks/github replayed with new delivery id; Code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	headers["X-GitHub-Delivery"] = "3"
+	headers["X-Hub-Signature-256"] = "sha256=" + sign("wrong-secret", body)
+
+	if w := deliver(api, "/webhooks/github", body, headers); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /webhooks/github wrong secret; Code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestWebhookRetriedAfterRateLimit(t *testing.T) {
+	api, c := webhookAPI(t)
+	api.Limiter = &Limiter{Address: Limits{Rate: 0.001, Burst: 1}}
+
+	body := `{"action": "opened"}`
+	headers := map[string]string{
+		"X-Hub-Signature-256": "sha256=" + sign("github-secret", body),
+		"X-GitHub-Delivery":   "1",
+	}
+
+	deliver(api, "/webhooks/github", body, headers)
+	<-c
+
+	body = `{"action": "closed"}`
+	headers["X-Hub-Signature-256"] = "sha256=" + sign("github-secret", body)
+	headers["X-GitHub-Delivery"] = "2"
+	if w := deliver(api, "/webhooks/github", body, headers); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("POST /webhooks/github over limit; Code = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+
+	api.Limiter = nil
+	if w := deliver(api, "/webhooks/github", body, headers); w.Code != http.StatusOK {
+		t.Errorf("POST /webhooks/github retried; Code = %v, want %v: %v", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestStripeWebhook(t *testing.T) {
+	api, c := webhookAPI(t)
+
+	body := `{"type": "charge.succeeded"}`
+
+	stripe := func(at time.Time) map[string]string {
+		timestamp := fmt.Sprint(at.Unix())
+		return map[string]string{"Stripe-Signature": "t=" + timestamp + ",v1=" + sign("stripe-secret", timestamp+"."+body)}
+	}
+
+	if w := deliver(api, "/webhooks/stripe/charges", body, stripe(time.Now())); w.Code != http.StatusOK {
+		t.Fatalf("POST /webhooks/stripe/charges; Code = %v, want %v: %v", w.Code, http.StatusOK, w.Body)
+	}
+
+	if m := <-c; m.Topic != "payments/charges" {
+		t.Errorf("POST /webhooks/stripe/charges; Topic = %v, want payments/charges", m.Topic)
+	}
+
+	if w := deliver(api, "/webhooks/stripe", body, stripe(time.Now().Add(-time.Hour))); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /webhooks/stripe stale; Code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	if w := deliver(api, "/webhooks/stripe", body, map[string]string{"Stripe-Signature": "t=1"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /webhooks/stripe unsigned; Code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestUnknownWebhook(t *testing.T) {
+	api, _ := webhookAPI(t)
+
+	if w := deliver(api, "/webhooks/gitlab", "{}", nil); w.Code != http.StatusNotFound {
+		t.Errorf("POST /webhooks/gitlab; Code = %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestNewWebhooksRejectsInvalidWebhooks(t *testing.T) {
+	cases := [][]Webhook{
+		{{Secret: "s3cret", Scheme: GitHubScheme}},
+		{{Name: "github", Scheme: GitHubScheme}},
+		{{Name: "github", Secret: "s3cret", Scheme: "gitlab"}},
+		{{Name: "github", Secret: "s3cret", Scheme: GitHubScheme, Topic: "github/#"}},
+		{{Name: "github", Secret: "s3cret", Scheme: GitHubScheme}, {Name: "github", Secret: "other", Scheme: GitHubScheme}},
+	}
+
+	for _, hooks := range cases {
+		if _, err := NewWebhooks(hooks); err == nil {
+			t.Errorf("NewWebhooks(%+v) = nil, want error", hooks)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package listener opens the network listeners of stem's hosts, serving TLS when configured.
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is how often the certificate files are checked for changes
+const DefaultReloadInterval = 10 * time.Second
+
+// TLS is used to specify the certificate and client authentication of a TLS listener
+type TLS struct {
+	CertFile string
+	KeyFile  string
+
+	// MinVersion is the oldest TLS version accepted, defaults to TLS 1.2, see ParseVersion
+	MinVersion uint16
+
+	// ClientCAFile, when set, verifies client certificates against the CAs it holds.
+	// Clients without a certificate are still accepted unless RequireClientCert is set.
+	ClientCAFile      string
+	RequireClientCert bool
+
+	// ReloadInterval is how often the files are checked, changed files are loaded by the next
+	// handshake. Defaults to DefaultReloadInterval.
+	ReloadInterval time.Duration
+}
+
+// ParseVersion converts "1.0", "1.1", "1.2" or "1.3" into a TLS version
+func ParseVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// Listen announces on the TCP address, serving TLS when config is set
+func Listen(addr string, config *TLS) (net.Listener, error) {
+	var tlsConfig *tls.Config
+
+	if config != nil {
+		var err error
+		if tlsConfig, err = config.Config(); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil || tlsConfig == nil {
+		return l, err
+	}
+
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// Scheme returns "https" when config is set, otherwise "http"
+func Scheme(config *TLS) string {
+	if config != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// URL returns the address a listener on addr is reached at, an address without a host is
+// reached on localhost, e.g. URL(":9988", nil) is http://localhost:9988
+func URL(addr string, config *TLS) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Scheme(config) + "://" + addr
+	}
+
+	if host == "" {
+		host = "localhost"
+	}
+
+	return Scheme(config) + "://" + net.JoinHostPort(host, port)
+}
+
+// Config loads the certificate files and returns a server configuration that reloads them when they change
+func (t *TLS) Config() (*tls.Config, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("TLS needs a certificate and key file")
+	}
+
+	if t.RequireClientCert && t.ClientCAFile == "" {
+		return nil, errors.New("TLS can not require client certificates without a client CA file")
+	}
+
+	r := &reloader{config: *t}
+	if r.config.MinVersion == 0 {
+		r.config.MinVersion = tls.VersionTLS12
+	}
+
+	if r.config.ReloadInterval <= 0 {
+		r.config.ReloadInterval = DefaultReloadInterval
+	}
+
+	if err := r.load(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:         r.config.MinVersion,
+		GetConfigForClient: r.getConfigForClient,
+	}, nil
+}
+
+// reloader holds the configuration loaded from the files and reloads it when they change
+type reloader struct {
+	sync.Mutex
+	config  TLS
+	current *tls.Config
+	stamps  []time.Time
+	checked time.Time
+}
+
+func (r *reloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if now := time.Now(); now.Sub(r.checked) >= r.config.ReloadInterval {
+		// A half written file fails to load, so the previous configuration is kept until the next check
+		if err := r.load(now); err != nil {
+			log.Println("Failed to reload TLS certificates:", err)
+		}
+	}
+
+	return r.current, nil
+}
+
+// load reads the files if they changed since they were last read, the lock must be held
+func (r *reloader) load(now time.Time) error {
+	r.checked = now
+
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+
+	stamps := make([]time.Time, len(files))
+	changed := r.current == nil
+
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		stamps[i] = info.ModTime()
+		changed = changed || !stamps[i].Equal(r.stamps[i])
+	}
+
+	if !changed {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   r.config.MinVersion,
+	}
+
+	if r.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %v", r.config.ClientCAFile)
+		}
+
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.config.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	r.current = config
+	r.stamps = stamps
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate generated for a test, signed by parent or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, commonName string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and key as PEM files in dir, returning their paths
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "stem-listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+// serve accepts connections on l and completes their handshakes until l is closed
+func serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn.(*tls.Conn).Handshake()
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}()
+	}
+}
+
+func listen(t *testing.T, config *TLS) net.Listener {
+	l, err := Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+	go serve(l)
+
+	return l
+}
+
+// dial completes a handshake with the listener, returning the server's certificate
+func dial(l net.Listener, config *tls.Config) (*x509.Certificate, error) {
+	conn, err := tls.Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// TLS 1.3 reports a rejected client certificate on the first read rather than the handshake
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+	}
+
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestListenServesTLS(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageServerAuth)
+	server := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := server.write(t, dir, "server")
+
+	l := listen(t, &TLS{CertFile: certFile, KeyFile: keyFile})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	cert, err := dial(l, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("dial() = %v, want nil", err)
+	}
+
+	if cert.Subject.CommonName != "server" {
+		t.Errorf("certificate common name = %v, want server", cert.Subject.CommonName)
+	}
+}
+
+func TestScheme(t *testing.T) {
+	if got := Scheme(nil); got != "http" {
+		t.Errorf("Scheme(nil) = %v, want http", got)
+	}
+
+	if got := Scheme(&TLS{}); got != "https" {
+		t.Errorf("Scheme(&TLS{}) = %v, want https", got)
+	}
+}
+
+func TestListenMinVersion(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+
+	l := listen(t, &TLS{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS13})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	if _, err := dial(l, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("dial(TLS 1.2) = nil, want error")
+	}
+
+	if _, err := dial(l, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS13}); err != nil {
+		t.Errorf("dial(TLS 1.3) = %v, want nil", err)
+	}
+}
+
+func TestListenReloadsCertificate(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := newTestCert(t, "first", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+
+	l := listen(t, &TLS{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// Move the old files back in time so the replacement is seen as changed on any file system
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(certFile, old, old)
+	os.Chtimes(keyFile, old, old)
+
+	newTestCert(t, "second", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+
+	cert, err := dial(l, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("dial() = %v, want nil", err)
+	}
+
+	if cert.Subject.CommonName != "second" {
+		t.Errorf("certificate common name = %v, want second", cert.Subject.CommonName)
+	}
+}
+
+func TestListenKeepsCertificateOnFailedReload(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+
+	l := listen(t, &TLS{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond})
+
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(certFile, old, old)
+	writeFile(t, certFile, []byte("half written"))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	if _, err := dial(l, &tls.Config{RootCAs: roots}); err != nil {
+		t.Errorf("dial() = %v, want nil", err)
+	}
+}
+
+func TestListenClientCertificates(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+
+	clientCA := newTestCert(t, "client ca", nil, x509.ExtKeyUsageClientAuth)
+	clientCAFile, _ := clientCA.write(t, dir, "client-ca")
+	device := newTestCert(t, "device", clientCA, x509.ExtKeyUsageClientAuth)
+	stranger := newTestCert(t, "stranger", newTestCert(t, "other ca", nil, x509.ExtKeyUsageClientAuth), x509.ExtKeyUsageClientAuth)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		require bool
+		client  *testCert
+		wantErr bool
+	}{
+		{false, nil, false},
+		{false, device, false},
+		{false, stranger, true},
+		{true, nil, true},
+		{true, device, false},
+		{true, stranger, true},
+	}
+
+	for _, test := range tests {
+		l := listen(t, &TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile, RequireClientCert: test.require})
+
+		config := &tls.Config{RootCAs: roots}
+		name := "none"
+		if test.client != nil {
+			cert := test.client.tlsCertificate()
+			// Certificates the server did not ask for are otherwise withheld by the client
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &cert, nil }
+			name = test.client.cert.Subject.CommonName
+		}
+
+		if _, err := dial(l, config); (err != nil) != test.wantErr {
+			t.Errorf("dial(require %v, client %v) = %v, want error %v", test.require, name, err, test.wantErr)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []TLS{
+		{},
+		{CertFile: "server.crt"},
+		{CertFile: "server.crt", KeyFile: "server.key", RequireClientCert: true},
+		{CertFile: "missing.crt", KeyFile: "missing.key"},
+	}
+
+	for _, test := range tests {
+		if _, err := test.Config(); err == nil {
+			t.Errorf("%+v.Config() = nil, want error", test)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	if got, err := ParseVersion("1.3"); err != nil || got != tls.VersionTLS13 {
+		t.Errorf("ParseVersion(1.3) = %v, %v, want %v, nil", got, err, tls.VersionTLS13)
+	}
+
+	if _, err := ParseVersion("3"); err == nil {
+		t.Error("ParseVersion(3) = nil error, want error")
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		addr   string
+		config *TLS
+		want   string
+	}{
+		{":9988", nil, "http://localhost:9988"},
+		{":9988", &TLS{}, "https://localhost:9988"},
+		{"127.0.0.1:9988", nil, "http://127.0.0.1:9988"},
+		{"[::1]:9988", nil, "http://[::1]:9988"},
+	}
+
+	for _, test := range tests {
+		if got := URL(test.addr, test.config); got != test.want {
+			t.Errorf("URL(%v, %v) = %v, want %v", test.addr, test.config, got, test.want)
+		}
+	}
+}
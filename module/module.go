@@ -0,0 +1,30 @@
+// Package module defines the lifecycle shared by the sources and sinks of messages the launcher runs.
+package module
+
+import "context"
+
+// Module is a source or sink of Hub messages that can be started and stopped
+type Module interface {
+	// Name labels the module's panel in the launcher, its lower case form names the
+	// module's routes, e.g. /websocket/start
+	Name() string
+
+	// Start begins taking or delivering messages
+	Start(ctx context.Context) error
+
+	// Stop ends the module once it has delivered the messages it holds, or closes it at once
+	// when ctx ends. Stopping a module that is not running does nothing.
+	Stop(ctx context.Context) error
+
+	Status() Status
+}
+
+// Status describes a module for the launcher
+type Status struct {
+	Running bool
+
+	// Location is where a running module listens, e.g. http://localhost:9988, empty if it does not
+	Location string
+	// Browsable marks a Location serving a page worth opening
+	Browsable bool
+}